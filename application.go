@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
@@ -12,14 +15,14 @@ import (
 
 var prefix = '%'
 
-var msgCommandHandlers = map[string]func(*Application, *discordgo.Session, *discordgo.MessageCreate){
-	"ping": func(app *Application, s *discordgo.Session, m *discordgo.MessageCreate) {
+var msgCommandHandlers = map[string]func(*Application, *discordgo.Session, *discordgo.MessageCreate) error{
+	"ping": func(app *Application, s *discordgo.Session, m *discordgo.MessageCreate) error {
 		start := time.Now()
 
 		sent, err := s.ChannelMessageSend(m.ChannelID, "Pong!")
 		if err != nil {
 			logrus.Errorf("Error responding to ping: %s", err)
-			return
+			return err
 		}
 
 		elapsed := time.Since(start)
@@ -27,38 +30,42 @@ var msgCommandHandlers = map[string]func(*Application, *discordgo.Session, *disc
 		_, err = s.ChannelMessageEdit(sent.ChannelID, sent.ID, fmt.Sprintf("Pong! **%s**", elapsed.String()))
 		if err != nil {
 			logrus.Errorf("Error editing ping message: %s", err)
-			return
+			return err
 		}
+		return nil
 	},
-	"map": func(app *Application, s *discordgo.Session, m *discordgo.MessageCreate) {
+	"map": func(app *Application, s *discordgo.Session, m *discordgo.MessageCreate) error {
 		r20, ok := app.Roll20ChannelMap[m.ChannelID]
 		if !ok {
 			logrus.Infof("Ignoring untracked channel %s", m.ChannelID)
-			return
+			return nil
 		}
 
-		picture, err := r20.GetMap()
+		picture, err := r20.GetMap(guildUploadLimit(s, m.GuildID))
 		if err != nil {
 			logrus.Errorf("Error getting map: %s", err)
-			return
+			return err
 		}
 
 		_, err = s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+			Content: picture.Note(),
 			Files: []*discordgo.File{
-				{Name: "map.jpg", Reader: picture},
+				{Name: picture.FileName("map"), Reader: picture.Reader()},
 			},
 		})
 		if err != nil {
 			logrus.Errorf("Cannot post picture: %s", err)
-			return
+			return err
 		}
+		return nil
 	},
-	"roll": func(a *Application, s *discordgo.Session, mc *discordgo.MessageCreate) {
-
+	"roll": func(a *Application, s *discordgo.Session, mc *discordgo.MessageCreate) error {
+		return nil
 	},
-	"debuginfo": func(a *Application, s *discordgo.Session, m *discordgo.MessageCreate) {
+	"debuginfo": func(a *Application, s *discordgo.Session, m *discordgo.MessageCreate) error {
 		logrus.Info(spew.Sdump(m))
-		s.ChannelMessageSend(m.ChannelID, "Debugging information printed to bot console.")
+		_, err := s.ChannelMessageSend(m.ChannelID, "Debugging information printed to bot console.")
+		return err
 	},
 }
 
@@ -68,10 +75,155 @@ func init() {
 	msgCommandHandlers["r"] = msgCommandHandlers["roll"]
 }
 
+var minFocusRadius = 1.0
+
+var minZoom, maxZoom = 10.0, 250.0
+
 var slashCommands = []*discordgo.ApplicationCommand{
 	{
 		Name:        "map",
 		Description: "Show roll20 map",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "focus",
+				Description: "Name of a token to center the map on",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "radius",
+				Description: "Number of grid squares to show around the focused token",
+				MinValue:    &minFocusRadius,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "at",
+				Description: "Show an archived map, e.g. \"5m ago\" or \"21:30\"",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "tiles",
+				Description: "Split the full resolution map into tiles",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "nameplates",
+				Description: "Take a new capture with or without token nameplates",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "tokens",
+				Description: "Take a new capture with or without tokens",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "zoom",
+				Description: "Take a new capture at this zoom level, a multiple of 10",
+				MinValue:    &minZoom,
+				MaxValue:    maxZoom,
+			},
+		},
+	},
+	{
+		Name:        "maphistory",
+		Description: "List recently archived roll20 maps",
+	},
+	{
+		Name:        "mapdiff",
+		Description: "Highlight what changed on the roll20 map",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "since",
+				Description: "Compare with the archived map at this time instead of the previous map",
+			},
+		},
+	},
+	{
+		Name:        "timelapse",
+		Description: "Animate the archived roll20 maps of a session",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "from",
+				Description: "Start of the timelapse, e.g. \"3h ago\" or \"19:00\"",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "to",
+				Description: "End of the timelapse, defaults to now",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "page",
+				Description: "Page to animate, defaults to the latest page in the time range",
+			},
+		},
+	},
+	{
+		Name:        "tokens",
+		Description: "List tokens on the current roll20 page",
+	},
+	{
+		Name:        "distance",
+		Description: "Measure the distance between two tokens or grid cells",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "from",
+				Description: "Token name or grid cell, e.g. C7",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "to",
+				Description: "Token name or grid cell, e.g. C7",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "rule",
+				Description: "Diagonal rule, defaults to the page setting",
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "5e", Value: string(Diagonal5e)},
+					{Name: "5-10-5", Value: string(Diagonal51015)},
+					{Name: "Euclidean", Value: string(DiagonalEuclidean)},
+					{Name: "Manhattan", Value: string(DiagonalManhattan)},
+				},
+			},
+		},
+	},
+	{
+		Name:        "live",
+		Description: "Automatically post the roll20 map to this channel when it changes",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "mode",
+				Description: "Turn live mode on or off",
+				Required:    true,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "on", Value: "on"},
+					{Name: "off", Value: "off"},
+				},
+			},
+		},
+	},
+	{
+		Name:        "livemap",
+		Description: "Post a pinned roll20 map that is kept up to date",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "mode",
+				Description: "Start or stop the live map, defaults to on",
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "on", Value: "on"},
+					{Name: "off", Value: "off"},
+				},
+			},
+		},
 	},
 	{
 		Name:        "characters",
@@ -89,10 +241,14 @@ var slashCommands = []*discordgo.ApplicationCommand{
 			},
 		},
 	},
+	{
+		Name:        "status",
+		Description: "Show the state of the roll20 browser, or of all of them to administrators",
+	},
 }
 
-var slashCommandHandlers = map[string]func(*Application, *discordgo.Session, *discordgo.InteractionCreate){
-	"map": func(app *Application, s *discordgo.Session, i *discordgo.InteractionCreate) {
+var slashCommandHandlers = map[string]func(*Application, *discordgo.Session, *discordgo.InteractionCreate) error{
+	"map": func(app *Application, s *discordgo.Session, i *discordgo.InteractionCreate) error {
 		r20, ok := app.Roll20ChannelMap[i.ChannelID]
 		if !ok {
 			logrus.Infof("Ignoring untracked channel %s", i.ChannelID)
@@ -105,38 +261,67 @@ var slashCommandHandlers = map[string]func(*Application, *discordgo.Session, *di
 			if err != nil {
 				logrus.Errorf("Error responding: %s", err)
 			}
-			return
+			return err
 		}
 
-		picture, err := r20.GetMap()
+		var picture *encodedImage
+		var content string
+		var err error
+		limit := guildUploadLimit(s, i.GuildID)
+		options := interactionOptions(i)
+		if tiles, ok := options["tiles"]; ok && tiles.BoolValue() {
+			return app.sendMapTiles(r20, s, i, limit)
+		}
+		if opts, ok := captureOptions(r20, options); ok {
+			return app.sendMapCapture(r20, s, i, opts, limit)
+		}
+		if at, ok := options["at"]; ok {
+			if _, ok := options["focus"]; ok {
+				err = fmt.Errorf("focus cannot be used with archived maps")
+			} else {
+				var captured time.Time
+				picture, captured, err = app.GetArchivedMap(r20, at.StringValue(), limit)
+				content = fmt.Sprintf("Map as of <t:%d:T>", captured.Unix())
+			}
+		} else if focus, ok := options["focus"]; ok {
+			radius := app.FocusRadius
+			if opt, ok := options["radius"]; ok {
+				radius = uint(opt.IntValue())
+			}
+			picture, err = r20.GetMapFocus(focus.StringValue(), radius, limit)
+		} else {
+			picture, err = r20.GetMap(limit)
+		}
 		if err != nil {
 			logrus.Errorf("Error getting map: %s", err)
-			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			respondErr := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseChannelMessageWithSource,
 				Data: &discordgo.InteractionResponseData{
-					Content: "Error getting map",
+					Content: fmt.Sprintf("Error getting map: %s", err),
 				},
 			})
-			if err != nil {
-				logrus.Errorf("Error responding: %s", err)
+			if respondErr != nil {
+				logrus.Errorf("Error responding: %s", respondErr)
 			}
-			return
+			return err
 		}
 
 		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
 			Data: &discordgo.InteractionResponseData{
+				Content: strings.TrimSpace(content + "\n" + picture.Note()),
 				Files: []*discordgo.File{
-					{Name: "map.jpg", Reader: picture},
+					{Name: picture.FileName("map"), Reader: picture.Reader()},
 				},
 			},
 		})
 		if err != nil {
 			logrus.Errorf("Cannot post picture: %s", err)
-			return
+			return err
 		}
+		return nil
 	},
-	"characters": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) {
+	"maphistory": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) error {
 		r20, ok := app.Roll20ChannelMap[ic.ChannelID]
 		if !ok {
 			logrus.Infof("Ignoring untracked channel %s", ic.ChannelID)
@@ -149,22 +334,384 @@ var slashCommandHandlers = map[string]func(*Application, *discordgo.Session, *di
 			if err != nil {
 				logrus.Errorf("Error responding: %s", err)
 			}
-			return
+			return err
+		}
+
+		content, err := app.GetMapHistory(r20)
+		if err != nil {
+			logrus.Errorf("Error getting map history: %s", err)
+			content = fmt.Sprintf("Error getting map history: %s", err)
+		}
+
+		respondErr := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+			},
+		})
+		if respondErr != nil {
+			logrus.Errorf("Error responding: %s", respondErr)
+			return respondErr
+		}
+		return err
+	},
+	"mapdiff": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) error {
+		r20, ok := app.Roll20ChannelMap[ic.ChannelID]
+		if !ok {
+			logrus.Infof("Ignoring untracked channel %s", ic.ChannelID)
+			err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Channel is untracked",
+				},
+			})
+			if err != nil {
+				logrus.Errorf("Error responding: %s", err)
+			}
+			return err
+		}
+
+		// comparing full resolution maps can take longer than Discord waits for a response
+		err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		})
+		if err != nil {
+			logrus.Errorf("Error responding: %s", err)
+			return err
+		}
+
+		since := ""
+		if opt, ok := interactionOptions(ic)["since"]; ok {
+			since = opt.StringValue()
+		}
+
+		edit := &discordgo.WebhookEdit{}
+		picture, content, err := app.GetMapDiff(r20, since, guildUploadLimit(s, ic.GuildID))
+		if err != nil {
+			logrus.Errorf("Error comparing maps: %s", err)
+			content = fmt.Sprintf("Error comparing maps: %s", err)
+		} else {
+			content = strings.TrimSpace(content + "\n" + picture.Note())
+			edit.Files = []*discordgo.File{
+				{Name: picture.FileName("mapdiff"), Reader: picture.Reader()},
+			}
+		}
+		edit.Content = &content
+
+		_, respondErr := s.InteractionResponseEdit(ic.Interaction, edit)
+		if respondErr != nil {
+			logrus.Errorf("Error responding: %s", respondErr)
+			return respondErr
+		}
+		return err
+	},
+	"timelapse": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) error {
+		r20, ok := app.Roll20ChannelMap[ic.ChannelID]
+		if !ok {
+			logrus.Infof("Ignoring untracked channel %s", ic.ChannelID)
+			err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Channel is untracked",
+				},
+			})
+			if err != nil {
+				logrus.Errorf("Error responding: %s", err)
+			}
+			return err
+		}
+
+		// rendering can take longer than Discord waits for a response
+		err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		})
+		if err != nil {
+			logrus.Errorf("Error responding: %s", err)
+			return err
+		}
+
+		options := interactionOptions(ic)
+		to, page := "now", ""
+		if opt, ok := options["to"]; ok {
+			to = opt.StringValue()
+		}
+		if opt, ok := options["page"]; ok {
+			page = opt.StringValue()
+		}
+
+		edit := &discordgo.WebhookEdit{}
+		anim, frames, err := app.GetTimelapse(r20, options["from"].StringValue(), to, page, guildUploadLimit(s, ic.GuildID))
+		if err != nil {
+			logrus.Errorf("Error building timelapse: %s", err)
+			content := fmt.Sprintf("Error building timelapse: %s", err)
+			edit.Content = &content
+		} else {
+			content := fmt.Sprintf("Timelapse of %d frames", frames)
+			edit.Content = &content
+			edit.Files = []*discordgo.File{
+				{Name: "timelapse.gif", Reader: anim},
+			}
+		}
+
+		_, respondErr := s.InteractionResponseEdit(ic.Interaction, edit)
+		if respondErr != nil {
+			logrus.Errorf("Error responding: %s", respondErr)
+			return respondErr
+		}
+		return err
+	},
+	"tokens": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) error {
+		r20, ok := app.Roll20ChannelMap[ic.ChannelID]
+		if !ok {
+			logrus.Infof("Ignoring untracked channel %s", ic.ChannelID)
+			err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Channel is untracked",
+				},
+			})
+			if err != nil {
+				logrus.Errorf("Error responding: %s", err)
+			}
+			return err
+		}
+
+		page, err := r20.GetPageData()
+		if err != nil {
+			logrus.Errorf("Error getting tokens: %s", err)
+			respondErr := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Error getting tokens",
+				},
+			})
+			if respondErr != nil {
+				logrus.Errorf("Error responding: %s", respondErr)
+			}
+			return err
+		}
+
+		err = s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: fmt.Sprintf("```\n%s\n```", formatTokenTable(page)),
+			},
+		})
+		if err != nil {
+			logrus.Errorf("Error responding: %s", err)
+			return err
+		}
+		return nil
+	},
+	"distance": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) error {
+		r20, ok := app.Roll20ChannelMap[ic.ChannelID]
+		if !ok {
+			logrus.Infof("Ignoring untracked channel %s", ic.ChannelID)
+			err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Channel is untracked",
+				},
+			})
+			if err != nil {
+				logrus.Errorf("Error responding: %s", err)
+			}
+			return err
+		}
+
+		content, err := func() (string, error) {
+			page, err := r20.GetPageData()
+			if err != nil {
+				return "", err
+			}
+
+			options := interactionOptions(ic)
+			from, err := page.ResolveLocation(options["from"].StringValue())
+			if err != nil {
+				return "", err
+			}
+			to, err := page.ResolveLocation(options["to"].StringValue())
+			if err != nil {
+				return "", err
+			}
+
+			var rule DiagonalRule
+			if opt, ok := options["rule"]; ok {
+				rule = DiagonalRule(opt.StringValue())
+			}
+
+			distance := page.Measure(from, to, rule)
+			content := fmt.Sprintf("**%s** to **%s**: %s", from.Name, to.Name, distance)
+			if distance.Rule != "" {
+				content += fmt.Sprintf(" (%s diagonals)", distance.Rule)
+			}
+			return content, nil
+		}()
+		if err != nil {
+			logrus.Errorf("Error measuring distance: %s", err)
+			content = fmt.Sprintf("Error measuring distance: %s", err)
+		}
+
+		respondErr := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+			},
+		})
+		if respondErr != nil {
+			logrus.Errorf("Error responding: %s", respondErr)
+			return respondErr
+		}
+		return err
+	},
+	"live": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) error {
+		r20, ok := app.Roll20ChannelMap[ic.ChannelID]
+		if !ok {
+			logrus.Infof("Ignoring untracked channel %s", ic.ChannelID)
+			err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Channel is untracked",
+				},
+			})
+			if err != nil {
+				logrus.Errorf("Error responding: %s", err)
+			}
+			return err
+		}
+
+		if interactionOptions(ic)["mode"].StringValue() == "off" {
+			err := app.SetLive(ic.ChannelID, false, nil)
+			if err != nil {
+				logrus.Errorf("Error saving live mode: %s", err)
+			}
+			respondErr := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Live map disabled",
+				},
+			})
+			if respondErr != nil {
+				logrus.Errorf("Error responding: %s", respondErr)
+			}
+			return err
+		}
+
+		data := &discordgo.InteractionResponseData{
+			Content: "Live map enabled",
+		}
+		capture := r20.getMapCapture()
+		if capture != nil {
+			picture, err := r20.fitMap(capture, guildUploadLimit(s, ic.GuildID))
+			if err != nil {
+				logrus.Errorf("Error encoding map: %s", err)
+			} else {
+				data.Files = []*discordgo.File{
+					{Name: picture.FileName("map"), Reader: picture.Reader()},
+				}
+			}
+		}
+		err := app.SetLive(ic.ChannelID, true, capture)
+		if err != nil {
+			logrus.Errorf("Error saving live mode: %s", err)
+		}
+
+		respondErr := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: data,
+		})
+		if respondErr != nil {
+			logrus.Errorf("Error responding: %s", respondErr)
+			return respondErr
+		}
+		return err
+	},
+	"livemap": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) error {
+		r20, ok := app.Roll20ChannelMap[ic.ChannelID]
+		if !ok {
+			logrus.Infof("Ignoring untracked channel %s", ic.ChannelID)
+			err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Channel is untracked",
+				},
+			})
+			if err != nil {
+				logrus.Errorf("Error responding: %s", err)
+			}
+			return err
+		}
+
+		// posting and pinning can take longer than Discord waits for a response
+		err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Flags: discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			logrus.Errorf("Error responding: %s", err)
+			return err
+		}
+
+		var content string
+		if opt, ok := interactionOptions(ic)["mode"]; ok && opt.StringValue() == "off" {
+			content = "Live map stopped"
+			err = app.StopLiveMap(ic.ChannelID)
+			if err != nil {
+				logrus.Errorf("Error stopping live map: %s", err)
+				content = "Error stopping live map"
+			}
+		} else if capture := r20.getMapCapture(); capture == nil {
+			content = "Map is not ready yet"
+			err = r20.mapNotReady()
+		} else {
+			content = "Live map posted"
+			err = app.StartLiveMap(ic.ChannelID, capture)
+			if err != nil {
+				logrus.Errorf("Error starting live map: %s", err)
+				content = "Error posting live map"
+			}
+		}
+
+		_, respondErr := s.InteractionResponseEdit(ic.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+		})
+		if respondErr != nil {
+			logrus.Errorf("Error responding: %s", respondErr)
+			return respondErr
+		}
+		return err
+	},
+	"characters": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) error {
+		r20, ok := app.Roll20ChannelMap[ic.ChannelID]
+		if !ok {
+			logrus.Infof("Ignoring untracked channel %s", ic.ChannelID)
+			err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Channel is untracked",
+				},
+			})
+			if err != nil {
+				logrus.Errorf("Error responding: %s", err)
+			}
+			return err
 		}
 
 		csList, err := r20.ListCharacterSheets()
 		if err != nil {
 			logrus.Errorf("Error getting character sheets: %s", err)
-			s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+			respondErr := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseChannelMessageWithSource,
 				Data: &discordgo.InteractionResponseData{
 					Content: "Error getting character sheets",
 				},
 			})
-			if err != nil {
-				logrus.Errorf("Error responding: %s", err)
+			if respondErr != nil {
+				logrus.Errorf("Error responding: %s", respondErr)
 			}
-			return
+			return err
 		}
 
 		err = s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
@@ -175,10 +722,11 @@ var slashCommandHandlers = map[string]func(*Application, *discordgo.Session, *di
 		})
 		if err != nil {
 			logrus.Errorf("Error responding: %s", err)
-			return
+			return err
 		}
+		return nil
 	},
-	"sheet": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) {
+	"sheet": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) error {
 		r20, ok := app.Roll20ChannelMap[ic.ChannelID]
 		if !ok {
 			logrus.Infof("Ignoring untracked channel %s", ic.ChannelID)
@@ -191,23 +739,23 @@ var slashCommandHandlers = map[string]func(*Application, *discordgo.Session, *di
 			if err != nil {
 				logrus.Errorf("Error responding: %s", err)
 			}
-			return
+			return err
 		}
 
 		character := ic.ApplicationCommandData().Options[0].StringValue()
 		cs, err := r20.GetCharacterSheet(character)
 		if err != nil {
 			logrus.Errorf("Error getting character sheet: %s", err)
-			err = s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+			respondErr := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseChannelMessageWithSource,
 				Data: &discordgo.InteractionResponseData{
 					Content: "Error getting character sheet",
 				},
 			})
-			if err != nil {
-				logrus.Errorf("Error responding: %s", err)
+			if respondErr != nil {
+				logrus.Errorf("Error responding: %s", respondErr)
 			}
-			return
+			return err
 		}
 
 		err = s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
@@ -220,33 +768,163 @@ var slashCommandHandlers = map[string]func(*Application, *discordgo.Session, *di
 		})
 		if err != nil {
 			logrus.Errorf("Error responding: %s", err)
-			return
+			return err
+		}
+		return nil
+	},
+	"status": func(app *Application, s *discordgo.Session, ic *discordgo.InteractionCreate) error {
+		// administrators see every game, which may be private to other
+		// channels, so their answer is only shown to them
+		admin := ic.Member != nil && ic.Member.Permissions&discordgo.PermissionAdministrator != 0
+		var (
+			instances []*Roll20Browser
+			flags     discordgo.MessageFlags
+		)
+		if admin {
+			instances = app.Roll20Instances
+			flags = discordgo.MessageFlagsEphemeral
+		} else if r20, ok := app.Roll20ChannelMap[ic.ChannelID]; ok {
+			instances = []*Roll20Browser{r20}
+		}
+
+		content := "Channel is untracked"
+		if len(instances) > 0 {
+			var healths []Health
+			for _, r20 := range instances {
+				healths = append(healths, r20.Health())
+			}
+			content = describeAll(healths)
 		}
+
+		err := s.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+				Flags:   flags,
+			},
+		})
+		if err != nil {
+			logrus.Errorf("Error responding: %s", err)
+			return err
+		}
+		return nil
 	},
 }
 
 type Application struct {
 	Config
+	BrowserPool      *BrowserPool
 	Roll20ChannelMap map[string]*Roll20Browser
 	Roll20Instances  []*Roll20Browser
 	Discord          *DiscordBot
 
-	closed bool
+	Archives     map[*Roll20Browser]*MapArchive
+	State        *State
+	liveChannels map[string]*liveChannel
+	liveMaps     map[string]*liveMap
+	liveLock     sync.Mutex
+
+	// location is the time zone of times given to commands without one.
+	location *time.Location
+
+	// handlers tracks running command handlers, which stop being started
+	// once shuttingDown is set.
+	handlerLock  sync.Mutex
+	handlers     sync.WaitGroup
+	inFlight     int64
+	shuttingDown bool
+
+	// ctx is canceled by Close to stop background work and pending
+	// requests, which are tracked by loops.
+	ctx    context.Context
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
+
+	httpServer *http.Server
 }
 
 func NewApplication(config Config) *Application {
+	ctx, cancel := context.WithCancel(context.Background())
 	app := &Application{
 		Config:           config,
+		BrowserPool:      NewBrowserPool(config.Headless, int(config.BrowserPoolSize)),
 		Roll20ChannelMap: make(map[string]*Roll20Browser),
+		liveChannels:     make(map[string]*liveChannel),
+		liveMaps:         make(map[string]*liveMap),
+		Archives:         make(map[*Roll20Browser]*MapArchive),
+		ctx:              ctx,
+		cancel:           cancel,
 	}
+	background, err := parseHexColor(config.VisibleBackground)
+	if err != nil {
+		panic(fmt.Errorf("invalid visible background: %w", err))
+	}
+	app.location, err = time.LoadLocation(config.TimeZone)
+	if err != nil {
+		panic(fmt.Errorf("invalid time zone: %w", err))
+	}
+	if config.TileSize == 0 {
+		panic(fmt.Errorf("tile size must be greater than zero"))
+	}
+	visible := VisibleOptions{
+		Background:     background,
+		Tolerance:      config.VisibleTolerance,
+		AlphaThreshold: config.VisibleAlpha,
+		Padding:        int(config.VisiblePadding),
+	}
+	browserLogLevel, err := parseBrowserLogLevel(config.BrowserLogLevel)
+	if err != nil {
+		panic(err)
+	}
+	selectors, err := LoadSelectorProfile(config.SelectorProfile)
+	if err != nil {
+		panic(fmt.Errorf("invalid selector profile: %w", err))
+	}
+	logrus.Printf("Using roll20 selector profile %s", selectors.Version)
 	for _, cfg := range config.Roll20Instances {
-		r20 := NewRoll20Browser(cfg.Roll20Email, cfg.Roll20Password, cfg.Roll20Game, config.Resolution, config.ViewportWidth, config.ViewportHeight)
+		format, err := parseImageFormat(cfg.OutputFormat)
+		if err != nil {
+			panic(fmt.Errorf("invalid output format for %s: %w", cfg.Roll20Game, err))
+		}
+		if err := cfg.Scraper.Validate(); err != nil {
+			panic(fmt.Errorf("invalid scraper options for %s: %w", cfg.Roll20Game, err))
+		}
+		if err := cfg.Browser.Validate(config.Headless); err != nil {
+			panic(fmt.Errorf("invalid browser options for %s: %w", cfg.Roll20Game, err))
+		}
+		r20 := NewRoll20Browser(app.BrowserPool, cfg.Roll20Email, cfg.Roll20Password, cfg.Roll20Game, Roll20Options{
+			Resolution:     config.Resolution,
+			ViewportWidth:  config.ViewportWidth,
+			ViewportHeight: config.ViewportHeight,
+			Visible:        visible,
+			Output: OutputOptions{
+				Format:   format,
+				Quality:  cfg.OutputQuality,
+				MaxBytes: cfg.OutputMaxBytes,
+			},
+			Scraper:         cfg.Scraper,
+			BrowserLogLevel: browserLogLevel,
+			Artifacts: ArtifactOptions{
+				Directory: config.ArtifactDirectory,
+				MaxCount:  config.ArtifactMaxCount,
+				Trace:     config.ArtifactTrace,
+			},
+			Selectors: selectors,
+			Headless:  config.Headless,
+			Browser:   cfg.Browser,
+		})
 		for _, target := range cfg.TargetChannels {
 			if _, ok := app.Roll20ChannelMap[target]; ok {
 				panic(fmt.Errorf("channel %s is tracking multiple roll20 instances", target))
 			}
 			app.Roll20ChannelMap[target] = r20
 		}
+		if config.ArchiveDirectory != "" {
+			archive := NewMapArchive(config.ArchiveDirectory, cfg.Roll20Game, config.ArchiveMaxCount, time.Duration(config.ArchiveMaxAge)*time.Hour)
+			r20.OnMapCapture(archiveMapHandler(archive))
+			app.Archives[r20] = archive
+		}
+		r20.OnMapCapture(app.liveMapHandler(r20))
 		app.Roll20Instances = append(app.Roll20Instances, r20)
 	}
 	app.Discord = NewDiscordBot(config.DiscordToken, config.DiscordStatus, app.DiscordMessageCreateHandler(), slashCommands, app.DiscordInteractionCreateHandler())
@@ -256,8 +934,21 @@ func NewApplication(config Config) *Application {
 func (app *Application) Launch() error {
 	var err error
 
+	app.State, err = LoadState(app.StateFile)
+	if err != nil {
+		return fmt.Errorf("error loading state: %w", err)
+	}
+	app.loadLiveState()
+
+	// the health endpoints are up while the browsers launch, which can
+	// take minutes
+	err = app.startHTTPServer()
+	if err != nil {
+		return fmt.Errorf("error starting HTTP server: %w", err)
+	}
+
 	for _, r20 := range app.Roll20Instances {
-		err = r20.Launch()
+		err = r20.Launch(app.ctx)
 		if err != nil {
 			return fmt.Errorf("error launching roll20: %w", err)
 		}
@@ -269,33 +960,53 @@ func (app *Application) Launch() error {
 	}
 
 	logrus.Printf("Application is ready")
-	go app.periodicRelaunch()
+	app.loops.Add(1)
+	go func() {
+		defer app.loops.Done()
+		app.periodicRelaunch(app.ctx)
+	}()
 
 	return nil
 }
 
-func (app *Application) periodicRelaunch() {
-	time.Sleep(time.Minute * 40)
-	for !app.closed {
+func (app *Application) periodicRelaunch(ctx context.Context) {
+	if sleepContext(ctx, time.Minute*40) != nil {
+		return
+	}
+	for ctx.Err() == nil {
 		logrus.Printf("Starting periodic reload")
 		for _, r20 := range app.Roll20Instances {
-			err := r20.Relaunch()
+			err := r20.Relaunch(ctx, RelaunchPeriodic)
 			if err != nil {
 				logrus.Errorf("Error reloading roll20: %s", err)
-				time.Sleep(time.Second * 10)
+				if sleepContext(ctx, time.Second*10) != nil {
+					return
+				}
 				continue
 			}
 		}
-		time.Sleep(time.Minute * 40)
+		if sleepContext(ctx, time.Minute*40) != nil {
+			return
+		}
 	}
 }
 
+// Close stops accepting commands and waits for running ones to finish, up
+// to the shutdown timeout. It then cancels background work and pending
+// requests and waits for the background goroutines to exit before closing
+// the browsers, the Discord connection and the HTTP server.
 func (app *Application) Close() {
-	app.closed = true
+	app.drainHandlers(time.Duration(app.ShutdownTimeout) * time.Second)
+	app.cancel()
+	app.loops.Wait()
 	for _, r20 := range app.Roll20Instances {
 		r20.Close()
 	}
-	app.Discord.Close()
+	app.BrowserPool.Close()
+	if err := app.Discord.Close(); err != nil {
+		logrus.Errorf("Error closing Discord: %s", err)
+	}
+	app.closeHTTPServer()
 }
 
 func (app *Application) DiscordMessageCreateHandler() MsgHandler {
@@ -326,17 +1037,167 @@ func (app *Application) DiscordMessageCreateHandler() MsgHandler {
 			return
 		}
 
-		// run command
-		go f(app, s, m)
+		// run command, unless shutting down
+		if !app.startHandler() {
+			commandsTotal.WithLabelValues(command, OutcomeRejected).Inc()
+			replyRestarting(s, m)
+			return
+		}
+		go func() {
+			defer app.finishHandler()
+			commandsTotal.WithLabelValues(command, commandOutcome(f(app, s, m))).Inc()
+		}()
 	}
 }
 
 func (app *Application) DiscordInteractionCreateHandler() SlashHandler {
 	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		if h, ok := slashCommandHandlers[i.ApplicationCommandData().Name]; ok {
-			go h(app, s, i)
+		name := i.ApplicationCommandData().Name
+		if h, ok := slashCommandHandlers[name]; ok {
+			if !app.startHandler() {
+				commandsTotal.WithLabelValues(name, OutcomeRejected).Inc()
+				respondRestarting(s, i)
+				return
+			}
+			go func() {
+				defer app.finishHandler()
+				commandsTotal.WithLabelValues(name, commandOutcome(h(app, s, i))).Inc()
+			}()
 		} else {
-			logrus.Errorf("Unknown slash command %s", i.ApplicationCommandData().Name)
+			commandsTotal.WithLabelValues(name, OutcomeUnknown).Inc()
+			logrus.Errorf("Unknown slash command %s", name)
+		}
+	}
+}
+
+// interactionOptions returns the options of a slash command keyed by name.
+func interactionOptions(i *discordgo.InteractionCreate) map[string]*discordgo.ApplicationCommandInteractionDataOption {
+	options := make(map[string]*discordgo.ApplicationCommandInteractionDataOption)
+	for _, opt := range i.ApplicationCommandData().Options {
+		options[opt.Name] = opt
+	}
+	return options
+}
+
+// captureOptions returns the scraper options of r20 with any overrides
+// given to /map applied. It returns false if there are none, in which case
+// the cached map can be used.
+func captureOptions(r20 *Roll20Browser, options map[string]*discordgo.ApplicationCommandInteractionDataOption) (ScraperOptions, bool) {
+	opts := r20.Scraper
+	overridden := false
+	if opt, ok := options["nameplates"]; ok {
+		opts.Nameplates = opt.BoolValue()
+		overridden = true
+	}
+	if opt, ok := options["tokens"]; ok {
+		if !opt.BoolValue() {
+			opts = opts.WithHiddenLayer("objects")
 		}
+		overridden = true
 	}
+	if opt, ok := options["zoom"]; ok {
+		opts.Zoom = int(opt.IntValue())
+		overridden = true
+	}
+	return opts, overridden
+}
+
+// sendMapCapture responds to /map with a new capture of the map taken with
+// the given options.
+func (app *Application) sendMapCapture(r20 *Roll20Browser, s *discordgo.Session, i *discordgo.InteractionCreate, opts ScraperOptions, limit int) error {
+	// capturing the map takes longer than Discord waits for a response
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		logrus.Errorf("Error responding: %s", err)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(app.ctx, captureMapTimeout)
+	defer cancel()
+	picture, err := r20.CaptureMap(ctx, opts, limit)
+	if err != nil {
+		logrus.Errorf("Error capturing map: %s", err)
+		content := fmt.Sprintf("Error capturing map: %s", err)
+		_, respondErr := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+		})
+		if respondErr != nil {
+			logrus.Errorf("Error responding: %s", respondErr)
+		}
+		return err
+	}
+
+	content := picture.Note()
+	_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: &content,
+		Files: []*discordgo.File{
+			{Name: picture.FileName("map"), Reader: picture.Reader()},
+		},
+	})
+	if err != nil {
+		logrus.Errorf("Cannot post picture: %s", err)
+	}
+	return err
+}
+
+// sendMapTiles responds to a /map interaction with an overview of the map
+// followed by full resolution tiles, in as many messages as needed.
+func (app *Application) sendMapTiles(r20 *Roll20Browser, s *discordgo.Session, i *discordgo.InteractionCreate, limit int) error {
+	// encoding every tile can take longer than Discord waits for a response
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		logrus.Errorf("Error responding: %s", err)
+		return err
+	}
+
+	overview, tiles, err := r20.GetMapTiles(app.TileSize, limit)
+	if err != nil {
+		logrus.Errorf("Error getting map tiles: %s", err)
+		content := fmt.Sprintf("Error getting map tiles: %s", err)
+		_, respondErr := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+		})
+		if respondErr != nil {
+			logrus.Errorf("Error responding: %s", respondErr)
+		}
+		return err
+	}
+
+	files := []*discordgo.File{
+		{Name: overview.FileName("overview"), Reader: overview.Reader()},
+	}
+	for n, tile := range tiles {
+		files = append(files, &discordgo.File{
+			Name:   tile.Image.FileName(fmt.Sprintf("tile_%02d_%s", n+1, tile.Label)),
+			Reader: tile.Image.Reader(),
+		})
+	}
+
+	content := fmt.Sprintf("Map split into %d tiles", len(tiles))
+	for n := 0; n < len(files); n += maxAttachments {
+		end := n + maxAttachments
+		if end > len(files) {
+			end = len(files)
+		}
+
+		if n == 0 {
+			_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+				Content: &content,
+				Files:   files[n:end],
+			})
+		} else {
+			_, err = s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+				Files: files[n:end],
+			})
+		}
+		if err != nil {
+			logrus.Errorf("Cannot post map tiles: %s", err)
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// archiveQuality is the JPEG quality of archived snapshots. Snapshots are
+// kept at full resolution, so they are compressed more than posted maps.
+const archiveQuality = 85
+
+var snapshotPattern = regexp.MustCompile(`^([0-9]+)_(-?[0-9]+)_(-?[0-9]+)\.jpg$`)
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// MapArchive stores full resolution map snapshots of a single roll20 game
+// on disk, in one directory per page.
+//
+// Snapshots are named after their capture time and the position of their
+// top left corner on the page, so crops made by getVisible can be lined up
+// again when they are loaded.
+type MapArchive struct {
+	directory string
+	maxCount  uint
+	maxAge    time.Duration
+
+	lock         sync.Mutex
+	lastArchived *mapCapture
+}
+
+// Snapshot is a map capture stored in an archive.
+type Snapshot struct {
+	Page string
+	Time time.Time
+	Min  image.Point
+
+	path string
+}
+
+// NewMapArchive creates an archive for the given game in directory.
+// A maxCount or maxAge of zero disables that retention limit.
+func NewMapArchive(directory, game string, maxCount uint, maxAge time.Duration) *MapArchive {
+	return &MapArchive{
+		directory: filepath.Join(directory, safePathName(game)),
+		maxCount:  maxCount,
+		maxAge:    maxAge,
+	}
+}
+
+func safePathName(name string) string {
+	name = strings.Trim(unsafePathChars.ReplaceAllString(name, "_"), "._")
+	if name == "" {
+		return "unnamed"
+	}
+	return name
+}
+
+// Save stores the capture, unless it is unchanged from the last one saved,
+// and then applies the retention limits.
+func (a *MapArchive) Save(capture *mapCapture) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.lastArchived != nil && mapDifference(a.lastArchived.full, capture.full) == 0 {
+		return nil
+	}
+
+	page := "unknown"
+	if capture.page != nil && capture.page.Page.Name != "" {
+		page = capture.page.Page.Name
+	}
+	dir := filepath.Join(a.directory, safePathName(page))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create archive directory: %w", err)
+	}
+
+	min := capture.full.Bounds().Min
+	name := fmt.Sprintf("%d_%d_%d.jpg", capture.time.UnixMilli(), min.X, min.Y)
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return fmt.Errorf("could not create snapshot: %w", err)
+	}
+	defer f.Close()
+
+	err = jpeg.Encode(f, capture.full, &jpeg.Options{Quality: archiveQuality})
+	if err != nil {
+		return fmt.Errorf("could not encode snapshot: %w", err)
+	}
+	a.lastArchived = capture
+
+	return a.prune()
+}
+
+// prune removes snapshots beyond the retention limits. The lock must be
+// held by the caller.
+func (a *MapArchive) prune() error {
+	snapshots, err := a.List()
+	if err != nil {
+		return err
+	}
+
+	for i, snapshot := range snapshots {
+		tooMany := a.maxCount > 0 && uint(i) >= a.maxCount
+		tooOld := a.maxAge > 0 && time.Since(snapshot.Time) > a.maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		err = os.Remove(snapshot.path)
+		if err != nil {
+			logrus.Errorf("Could not remove archived snapshot: %s", err)
+		}
+	}
+	return nil
+}
+
+// List returns the archived snapshots, newest first.
+func (a *MapArchive) List() ([]Snapshot, error) {
+	pages, err := os.ReadDir(a.directory)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read archive directory: %w", err)
+	}
+
+	var snapshots []Snapshot
+	for _, page := range pages {
+		if !page.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(a.directory, page.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read archive directory: %w", err)
+		}
+		for _, file := range files {
+			match := snapshotPattern.FindStringSubmatch(file.Name())
+			if match == nil {
+				continue
+			}
+			millis, _ := strconv.ParseInt(match[1], 10, 64)
+			x, _ := strconv.Atoi(match[2])
+			y, _ := strconv.Atoi(match[3])
+			snapshots = append(snapshots, Snapshot{
+				Page: page.Name(),
+				Time: time.UnixMilli(millis),
+				Min:  image.Pt(x, y),
+				path: filepath.Join(a.directory, page.Name(), file.Name()),
+			})
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// At returns the latest snapshot taken at or before t.
+func (a *MapArchive) At(t time.Time) (Snapshot, error) {
+	snapshots, err := a.List()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, snapshot := range snapshots {
+		if !snapshot.Time.After(t) {
+			return snapshot, nil
+		}
+	}
+	return Snapshot{}, fmt.Errorf("no map archived at or before %s", t.Format(time.RFC1123))
+}
+
+// Load decodes the snapshot. The returned image uses page pixel coordinates,
+// the same as the capture it was saved from.
+func (s Snapshot) Load() (image.Image, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode snapshot: %w", err)
+	}
+
+	rect := img.Bounds()
+	result := image.NewNRGBA(rect.Sub(rect.Min).Add(s.Min))
+	draw.Draw(result, result.Rect, img, rect.Min, draw.Src)
+	return result, nil
+}
+
+// parseTimeQuery parses either a time in the past relative to now, such as
+// "5m ago" or "1h30m", or an absolute time. Times without a time zone are in
+// the location of now, and times without a date are taken to be within the
+// last day.
+func parseTimeQuery(query string, now time.Time) (time.Time, error) {
+	query = strings.TrimSpace(query)
+	if strings.EqualFold(query, "now") {
+		return now, nil
+	}
+
+	relative := strings.TrimSpace(strings.TrimSuffix(query, "ago"))
+	if d, err := time.ParseDuration(relative); err == nil {
+		return now.Add(-d), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, query); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, query, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, query, now.Location()); err == nil {
+			y, m, d := now.Date()
+			result := time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+			if result.After(now) {
+				// a time later than now most likely refers to last night
+				result = result.AddDate(0, 0, -1)
+			}
+			return result, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("could not understand time %q, try \"5m ago\" or \"21:30\"", query)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/playwright-community/playwright-go"
+	"github.com/sirupsen/logrus"
+)
+
+// artifactTimeFormat names failure artifacts so that they sort by time.
+const artifactTimeFormat = "2006-01-02T15-04-05.000"
+
+// ArtifactOptions controls what is saved when an operation of a
+// Roll20Browser fails.
+type ArtifactOptions struct {
+	// Directory is where artifacts are saved, in one directory per game.
+	// An empty directory disables artifacts.
+	Directory string
+	// MaxCount is how many failures are kept per game. Zero keeps all of
+	// them.
+	MaxCount uint
+	// Trace records a Playwright trace of each operation, which is saved
+	// along with the other artifacts if the operation fails.
+	Trace bool
+}
+
+func (r *Roll20Browser) artifactDirectory() string {
+	return filepath.Join(r.Artifacts.Directory, safePathName(r.game))
+}
+
+// startTrace starts recording a trace of the page's context, if enabled.
+// It is called after logging in, so the first chunk covers the rest of the
+// launch and a launch that fails at the login saves no trace.
+func (r *Roll20Browser) startTrace() {
+	if r.Artifacts.Directory == "" || !r.Artifacts.Trace {
+		return
+	}
+	err := r.page.Context().Tracing().Start(playwright.TracingStartOptions{
+		Screenshots: playwright.Bool(true),
+		Snapshots:   playwright.Bool(true),
+	})
+	if err != nil {
+		logrus.Errorf("Could not start trace: %s", err)
+		return
+	}
+	r.tracing = true
+}
+
+// restartTrace discards the trace recorded so far and starts a new chunk,
+// so that a saved trace only covers the operation that failed.
+func (r *Roll20Browser) restartTrace() {
+	if !r.tracing || r.page == nil {
+		return
+	}
+	tracing := r.page.Context().Tracing()
+	if err := tracing.StopChunk(); err != nil {
+		logrus.Errorf("Could not stop trace chunk: %s", err)
+	}
+	if err := tracing.StartChunk(); err != nil {
+		logrus.Errorf("Could not start trace chunk: %s", err)
+	}
+}
+
+// saveFailureArtifacts saves a screenshot, the page HTML and the trace, if
+// enabled, after operation failed with err. Files that cannot be saved are
+// skipped, since the page may be what broke.
+func (r *Roll20Browser) saveFailureArtifacts(operation string, err error) {
+	if r.Artifacts.Directory == "" || r.page == nil {
+		return
+	}
+
+	dir := r.artifactDirectory()
+	if mkdirErr := os.MkdirAll(dir, 0755); mkdirErr != nil {
+		logrus.Errorf("Could not create artifact directory: %s", mkdirErr)
+		return
+	}
+	base := filepath.Join(dir, fmt.Sprintf("%s_%s", time.Now().Format(artifactTimeFormat), operation))
+
+	var saved []string
+	screenshot := base + ".png"
+	_, screenshotErr := r.page.Screenshot(playwright.PageScreenshotOptions{
+		Path:     playwright.String(screenshot),
+		FullPage: playwright.Bool(true),
+	})
+	if screenshotErr != nil {
+		logrus.Errorf("Could not save screenshot: %s", screenshotErr)
+	} else {
+		saved = append(saved, screenshot)
+	}
+
+	html := base + ".html"
+	content, contentErr := r.page.Content()
+	if contentErr == nil {
+		contentErr = os.WriteFile(html, []byte(content), 0644)
+	}
+	if contentErr != nil {
+		logrus.Errorf("Could not save page HTML: %s", contentErr)
+	} else {
+		saved = append(saved, html)
+	}
+
+	if r.tracing {
+		trace := base + ".zip"
+		tracing := r.page.Context().Tracing()
+		traceErr := tracing.StopChunk(playwright.TracingStopChunkOptions{Path: playwright.String(trace)})
+		if traceErr != nil {
+			logrus.Errorf("Could not save trace: %s", traceErr)
+		} else {
+			saved = append(saved, trace)
+		}
+		if traceErr = tracing.StartChunk(); traceErr != nil {
+			logrus.Errorf("Could not start trace chunk: %s", traceErr)
+		}
+	}
+
+	logrus.WithField("instance", r.game).Errorf("%s failed: %s; saved %s", operation, err, strings.Join(saved, ", "))
+
+	if pruneErr := r.pruneArtifacts(); pruneErr != nil {
+		logrus.Errorf("Could not prune artifacts: %s", pruneErr)
+	}
+}
+
+// pruneArtifacts removes the artifacts of all but the newest MaxCount
+// failures.
+func (r *Roll20Browser) pruneArtifacts() error {
+	if r.Artifacts.MaxCount == 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(r.artifactDirectory())
+	if err != nil {
+		return fmt.Errorf("could not read artifact directory: %w", err)
+	}
+
+	// the artifacts of a failure share their name up to the extension
+	files := make(map[string][]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		failure := strings.TrimSuffix(name, filepath.Ext(name))
+		files[failure] = append(files[failure], name)
+	}
+	var failures []string
+	for failure := range files {
+		failures = append(failures, failure)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(failures)))
+
+	for i := int(r.Artifacts.MaxCount); i < len(failures); i++ {
+		for _, name := range files[failures[i]] {
+			err = os.Remove(filepath.Join(r.artifactDirectory(), name))
+			if err != nil {
+				return fmt.Errorf("could not remove artifact: %w", err)
+			}
+		}
+	}
+	return nil
+}
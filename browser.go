@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/playwright-community/playwright-go"
+)
+
+// BrowserOptions controls which browser a Roll20Browser drives and how it
+// is set up.
+type BrowserOptions struct {
+	// Engine is chromium, firefox or webkit. Headless mode needs chromium,
+	// which is the only engine that can render sheets to PDF. In headed
+	// mode, sheets are only printed with chromium's kiosk printing and fail
+	// with the other engines, which still capture maps.
+	Engine string `json:"engine" default:"chromium"`
+	// Args are passed to the browser on top of the ones the bot needs.
+	Args []string `json:"args"`
+
+	// Proxy is an HTTP or SOCKS proxy, e.g. "socks5://proxy:1080".
+	Proxy         string `json:"proxy"`
+	ProxyBypass   string `json:"proxy_bypass"`
+	ProxyUsername string `json:"proxy_username"`
+	ProxyPassword string `json:"proxy_password"`
+
+	UserAgent string `json:"user_agent"`
+	Locale    string `json:"locale"`
+	Timezone  string `json:"timezone"`
+	// DeviceScaleFactor scales the page, so a factor of 2 renders at twice
+	// the resolution. Zero leaves the browser default. Map captures are
+	// sized in CSS pixels, so use Scraper.Zoom to change their resolution.
+	DeviceScaleFactor float64 `json:"device_scale_factor"`
+
+	// WSEndpoint connects to a running Playwright browser server instead of
+	// launching a browser.
+	WSEndpoint string `json:"ws_endpoint"`
+	// CDPEndpoint connects to a running chromium over the Chrome DevTools
+	// Protocol instead of launching a browser.
+	CDPEndpoint string `json:"cdp_endpoint"`
+}
+
+// Validate checks that the engine is known and that the options can be
+// used together and in headless mode, if set.
+func (o BrowserOptions) Validate(headless bool) error {
+	switch o.Engine {
+	case "chromium", "firefox", "webkit":
+	default:
+		return fmt.Errorf("unknown browser engine %q", o.Engine)
+	}
+	if headless && o.Engine != "chromium" {
+		return fmt.Errorf("headless mode requires the chromium engine to render character sheets")
+	}
+	if o.WSEndpoint != "" && o.CDPEndpoint != "" {
+		return fmt.Errorf("only one of ws_endpoint and cdp_endpoint may be set")
+	}
+	if o.CDPEndpoint != "" && o.Engine != "chromium" {
+		return fmt.Errorf("cdp_endpoint requires the chromium engine")
+	}
+	if o.DeviceScaleFactor < 0 {
+		return fmt.Errorf("device scale factor must not be negative")
+	}
+	return nil
+}
+
+func (o BrowserOptions) browserType(pw *playwright.Playwright) playwright.BrowserType {
+	switch o.Engine {
+	case "firefox":
+		return pw.Firefox
+	case "webkit":
+		return pw.WebKit
+	default:
+		return pw.Chromium
+	}
+}
+
+// start launches the configured browser, or connects to it if an endpoint
+// is set.
+func (o BrowserOptions) start(pw *playwright.Playwright, headless bool) (playwright.Browser, error) {
+	browserType := o.browserType(pw)
+
+	if o.WSEndpoint != "" {
+		browser, err := browserType.Connect(o.WSEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to browser at %s: %w", o.WSEndpoint, err)
+		}
+		return browser, nil
+	}
+	if o.CDPEndpoint != "" {
+		browser, err := browserType.ConnectOverCDP(o.CDPEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to browser at %s: %w", o.CDPEndpoint, err)
+		}
+		return browser, nil
+	}
+
+	var args []string
+	if o.Engine == "chromium" {
+		// headed browsers print sheets with cups-pdf, headless ones render
+		// them with Playwright and need WebGL enabled in software for the map
+		args = []string{"--kiosk-printing"}
+		if headless {
+			args = []string{"--use-gl=swiftshader", "--enable-unsafe-swiftshader", "--ignore-gpu-blocklist"}
+		}
+	}
+	args = append(args, o.Args...)
+
+	browser, err := browserType.Launch(playwright.BrowserTypeLaunchOptions{
+		Headless: playwright.Bool(headless),
+		Args:     args,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not launch %s: %w", o.Engine, err)
+	}
+	return browser, nil
+}
+
+// contextOptions returns the options of the browser context the game is
+// opened in.
+func (r *Roll20Browser) contextOptions() playwright.BrowserNewContextOptions {
+	options := playwright.BrowserNewContextOptions{
+		AcceptDownloads: playwright.Bool(true),
+		Viewport: &playwright.BrowserNewContextOptionsViewport{
+			Height: playwright.Int(int(r.ViewportHeight)),
+			Width:  playwright.Int(int(r.ViewportWidth)),
+		},
+	}
+	if r.Browser.Proxy != "" {
+		options.Proxy = &playwright.BrowserNewContextOptionsProxy{
+			Server: playwright.String(r.Browser.Proxy),
+		}
+		if r.Browser.ProxyBypass != "" {
+			options.Proxy.Bypass = playwright.String(r.Browser.ProxyBypass)
+		}
+		if r.Browser.ProxyUsername != "" {
+			options.Proxy.Username = playwright.String(r.Browser.ProxyUsername)
+			options.Proxy.Password = playwright.String(r.Browser.ProxyPassword)
+		}
+	}
+	if r.Browser.UserAgent != "" {
+		options.UserAgent = playwright.String(r.Browser.UserAgent)
+	}
+	if r.Browser.Locale != "" {
+		options.Locale = playwright.String(r.Browser.Locale)
+	}
+	if r.Browser.Timezone != "" {
+		options.TimezoneId = playwright.String(r.Browser.Timezone)
+	}
+	if r.Browser.DeviceScaleFactor > 0 {
+		options.DeviceScaleFactor = playwright.Float(r.Browser.DeviceScaleFactor)
+	}
+	return options
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/playwright-community/playwright-go"
+	"github.com/sirupsen/logrus"
+)
+
+// consoleLevels maps the type of a browser console message to the level it
+// is logged at. Types not listed are logged at debug level.
+var consoleLevels = map[string]logrus.Level{
+	"error":   logrus.ErrorLevel,
+	"assert":  logrus.ErrorLevel,
+	"warning": logrus.WarnLevel,
+	"log":     logrus.InfoLevel,
+	"info":    logrus.InfoLevel,
+}
+
+// parseBrowserLogLevel parses the lowest level of browser output that is
+// forwarded to the log. "none" disables forwarding.
+func parseBrowserLogLevel(s string) (logrus.Level, error) {
+	if strings.ToLower(s) == "none" {
+		return logrus.PanicLevel, nil
+	}
+	level, err := logrus.ParseLevel(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid browser log level: %w", err)
+	}
+	return level, nil
+}
+
+// forwardBrowserLogs sends console messages, uncaught errors, crashes and
+// failed requests of the page to the log. Playwright calls the listeners
+// while holding its event lock, so they must not use the page.
+func (r *Roll20Browser) forwardBrowserLogs(page playwright.Page) {
+	log := func(level logrus.Level, source string, format string, args ...interface{}) {
+		if level > r.BrowserLogLevel {
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"instance": r.game,
+			"source":   source,
+		}).Logf(level, format, args...)
+	}
+
+	page.On("console", func(msg playwright.ConsoleMessage) {
+		level, ok := consoleLevels[msg.Type()]
+		if !ok {
+			level = logrus.DebugLevel
+		}
+		log(level, "console", "Browser console: %s", msg.Text())
+	})
+	page.On("pageerror", func(err error) {
+		log(logrus.ErrorLevel, "pageerror", "Uncaught error in page: %s", err)
+	})
+	page.On("crash", func() {
+		log(logrus.ErrorLevel, "crash", "Browser page crashed")
+	})
+	page.On("requestfailed", func(request playwright.Request) {
+		reason := "unknown error"
+		if failure := request.Failure(); failure != nil {
+			reason = failure.ErrorText
+		}
+		log(logrus.WarnLevel, "requestfailed", "Request to %s failed: %s", request.URL(), reason)
+	})
+}
@@ -1,20 +1,72 @@
 package main
 
-import "github.com/creasty/defaults"
+import (
+	"encoding/json"
+
+	"github.com/creasty/defaults"
+)
+
+type Roll20InstanceConfig struct {
+	Roll20Email    string   `json:"roll20_email" default:"jdoe123@example.com"`
+	Roll20Password string   `json:"roll20_password" default:"password"`
+	Roll20Game     string   `json:"roll20_game" default:"My Game"`
+	TargetChannels []string `json:"target_channels"`
+	OutputFormat   string   `json:"output_format" default:"jpeg"`
+	OutputQuality  int      `json:"output_quality" default:"75"`
+	OutputMaxBytes int      `json:"output_max_bytes" default:"0"`
+	// Scraper controls how scrape.js captures the map of this instance.
+	Scraper ScraperOptions `json:"scraper"`
+	// Browser controls which browser this instance runs and how.
+	Browser BrowserOptions `json:"browser"`
+}
+
+// UnmarshalJSON fills in defaults for settings missing from an instance,
+// since defaults are not applied to the elements of Config.Roll20Instances.
+func (c *Roll20InstanceConfig) UnmarshalJSON(data []byte) error {
+	type plain Roll20InstanceConfig
+	result := plain{}
+	if err := defaults.Set(&result); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	*c = Roll20InstanceConfig(result)
+	return nil
+}
 
 type Config struct {
-	Roll20Instances []struct {
-		Roll20Email    string   `json:"roll20_email" default:"jdoe123@example.com"`
-		Roll20Password string   `json:"roll20_password" default:"password"`
-		Roll20Game     string   `json:"roll20_game" default:"My Game"`
-		TargetChannels []string `json:"target_channels"`
-	} `json:"roll20_instances"`
-	DiscordToken   string `json:"discord_token" default:"ABC.123.XYZ"`
-	DiscordStatus  string `json:"discord_status" default:""`
-	Resolution     uint   `json:"resolution" default:"2000"`
-	ViewportWidth  uint   `json:"viewport_width" default:"1280"`
-	ViewportHeight uint   `json:"viewport_height" default:"720"`
-	TimeDelay      uint   `json:"time_delay" default:"10"`
+	Roll20Instances   []Roll20InstanceConfig `json:"roll20_instances"`
+	DiscordToken      string                 `json:"discord_token" default:"ABC.123.XYZ"`
+	DiscordStatus     string                 `json:"discord_status" default:""`
+	Resolution        uint                   `json:"resolution" default:"2000"`
+	ViewportWidth     uint                   `json:"viewport_width" default:"1280"`
+	ViewportHeight    uint                   `json:"viewport_height" default:"720"`
+	TimeDelay         uint                   `json:"time_delay" default:"10"`
+	FocusRadius       uint                   `json:"focus_radius" default:"5"`
+	LiveThreshold     float64                `json:"live_threshold" default:"0.005"`
+	LiveInterval      uint                   `json:"live_interval" default:"60"`
+	StateFile         string                 `json:"state_file" default:"roll20mapbot.state.json"`
+	ArchiveDirectory  string                 `json:"archive_directory" default:""`
+	ArchiveMaxCount   uint                   `json:"archive_max_count" default:"500"`
+	ArchiveMaxAge     uint                   `json:"archive_max_age_hours" default:"168"`
+	TimeZone          string                 `json:"time_zone" default:"UTC"`
+	DiffTolerance     uint8                  `json:"diff_tolerance" default:"32"`
+	VisibleBackground string                 `json:"visible_background" default:"#000000"`
+	VisibleTolerance  uint8                  `json:"visible_tolerance" default:"16"`
+	VisibleAlpha      uint8                  `json:"visible_alpha_threshold" default:"16"`
+	VisiblePadding    uint                   `json:"visible_padding" default:"0"`
+	TileSize          uint                   `json:"tile_size" default:"1024"`
+	BrowserLogLevel   string                 `json:"browser_log_level" default:"warning"`
+	ArtifactDirectory string                 `json:"artifact_directory" default:""`
+	ArtifactMaxCount  uint                   `json:"artifact_max_count" default:"20"`
+	ArtifactTrace     bool                   `json:"artifact_trace" default:"false"`
+	SelectorProfile   string                 `json:"selector_profile" default:""`
+	Headless          bool                   `json:"headless" default:"false"`
+	BrowserPoolSize   uint                   `json:"browser_pool_size" default:"1"`
+	ShutdownTimeout   uint                   `json:"shutdown_timeout" default:"30"`
+	HTTPAddress       string                 `json:"http_address" default:""`
+	ReadyMapAge       uint                   `json:"ready_map_age" default:"300"`
 }
 
 func DefaultConfig() Config {
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/nfnt/resize"
+)
+
+// diffSampleWidth is the width maps are scaled down to before being
+// compared for changes.
+const diffSampleWidth = 256
+
+// diffTolerance is the amount a color channel may differ by, out of 255,
+// before a pixel is considered changed. It absorbs scaling and compression
+// noise.
+const diffTolerance = 24
+
+// mapDifference returns the fraction of pixels that differ between two map
+// captures, from 0 for identical maps to 1 for completely different ones.
+// Captures with different visible areas are always completely different.
+func mapDifference(a, b image.Image) float64 {
+	if a.Bounds() != b.Bounds() {
+		return 1
+	}
+
+	sa := toNRGBA(resize.Resize(diffSampleWidth, 0, a, resize.Bilinear))
+	sb := toNRGBA(resize.Resize(diffSampleWidth, 0, b, resize.Bilinear))
+
+	rect := sa.Bounds()
+	total := rect.Dx() * rect.Dy()
+	if total == 0 {
+		return 0
+	}
+
+	changed := 0
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if pixelChanged(sa, sb, x, y, diffTolerance) {
+				changed++
+			}
+		}
+	}
+	return float64(changed) / float64(total)
+}
+
+// pixelChanged reports whether any color channel of the pixel at (x, y)
+// differs by more than tolerance between the two images.
+func pixelChanged(a, b *image.NRGBA, x, y int, tolerance uint8) bool {
+	pa := a.Pix[a.PixOffset(x, y):]
+	pb := b.Pix[b.PixOffset(x, y):]
+	for i := 0; i < 3; i++ {
+		d := int(pa[i]) - int(pb[i])
+		if d < 0 {
+			d = -d
+		}
+		if d > int(tolerance) {
+			return true
+		}
+	}
+	return false
+}
+
+// toNRGBA converts an image to *image.NRGBA, copying only if needed.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		return nrgba
+	}
+	rect := img.Bounds()
+	nrgba := image.NewNRGBA(rect)
+	draw.Draw(nrgba, rect, img, rect.Min, draw.Src)
+	return nrgba
+}
+
+// diffBlockSize is the size in pixels of the squares changes are grouped
+// into when highlighting them.
+const diffBlockSize = 16
+
+// diffBlockThreshold is the number of changed pixels needed to mark a block
+// as changed, so that scattered compression artifacts are ignored.
+const diffBlockThreshold = diffBlockSize * diffBlockSize / 16
+
+// highlightChanges draws after with the regions that differ from before
+// tinted and outlined. Both images are first placed into the union of their
+// bounds, so captures cropped differently by getVisible still line up. It
+// returns the highlighted image and the fraction of the map that changed.
+func highlightChanges(before, after image.Image, tolerance uint8) (image.Image, float64) {
+	union := before.Bounds().Union(after.Bounds())
+	a := image.NewNRGBA(union)
+	draw.Draw(a, before.Bounds(), before, before.Bounds().Min, draw.Src)
+	b := image.NewNRGBA(union)
+	draw.Draw(b, after.Bounds(), after, after.Bounds().Min, draw.Src)
+
+	cols := (union.Dx() + diffBlockSize - 1) / diffBlockSize
+	rows := (union.Dy() + diffBlockSize - 1) / diffBlockSize
+	changed := make([]bool, cols*rows)
+	isChanged := func(col, row int) bool {
+		if col < 0 || row < 0 || col >= cols || row >= rows {
+			return false
+		}
+		return changed[row*cols+col]
+	}
+
+	blockRect := func(col, row int) image.Rectangle {
+		min := union.Min.Add(image.Pt(col*diffBlockSize, row*diffBlockSize))
+		return image.Rectangle{Min: min, Max: min.Add(image.Pt(diffBlockSize, diffBlockSize))}.Intersect(union)
+	}
+
+	count := 0
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			rect := blockRect(col, row)
+			pixels := 0
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					if pixelChanged(a, b, x, y, tolerance) {
+						pixels++
+					}
+				}
+			}
+			if pixels >= diffBlockThreshold {
+				changed[row*cols+col] = true
+				count++
+			}
+		}
+	}
+
+	tint := image.NewUniform(color.NRGBA{R: 255, A: 96})
+	outline := image.NewUniform(color.NRGBA{R: 255, A: 255})
+	const width = 2
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			if !isChanged(col, row) {
+				continue
+			}
+			rect := blockRect(col, row)
+			draw.Draw(b, rect, tint, image.Point{}, draw.Over)
+
+			// outline the edges that border unchanged blocks
+			if !isChanged(col, row-1) {
+				draw.Draw(b, image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+width), outline, image.Point{}, draw.Src)
+			}
+			if !isChanged(col, row+1) {
+				draw.Draw(b, image.Rect(rect.Min.X, rect.Max.Y-width, rect.Max.X, rect.Max.Y), outline, image.Point{}, draw.Src)
+			}
+			if !isChanged(col-1, row) {
+				draw.Draw(b, image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+width, rect.Max.Y), outline, image.Point{}, draw.Src)
+			}
+			if !isChanged(col+1, row) {
+				draw.Draw(b, image.Rect(rect.Max.X-width, rect.Min.Y, rect.Max.X, rect.Max.Y), outline, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	return b, float64(count) / float64(len(changed))
+}
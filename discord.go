@@ -65,8 +65,74 @@ func (d *DiscordBot) Launch() error {
 	return nil
 }
 
-func (d *DiscordBot) Close() {
+func (d *DiscordBot) Session() *discordgo.Session {
+	return d.session
+}
+
+// Connected reports whether the gateway connection is up. It turns false
+// when the connection drops and true again once a heartbeat succeeds.
+func (d *DiscordBot) Connected() bool {
+	if d.session == nil {
+		return false
+	}
+	d.session.RLock()
+	defer d.session.RUnlock()
+	return d.session.DataReady
+}
+
+// Close closes the gateway connection. It does nothing if the bot was
+// never launched.
+func (d *DiscordBot) Close() error {
+	if d.session == nil {
+		return nil
+	}
 	if err := d.session.Close(); err != nil {
-		panic(err)
+		return fmt.Errorf("error closing Discord session: %w", err)
+	}
+	return nil
+}
+
+// discordUploadLimit is the largest attachment Discord accepts in direct
+// messages and in guilds below boost tier 2.
+const discordUploadLimit = 10 << 20
+
+// channelUploadLimit returns the largest attachment, in bytes, that can be
+// posted to the channel, which is the limit of its guild.
+func channelUploadLimit(s *discordgo.Session, channelID string) int {
+	channel, err := s.State.Channel(channelID)
+	if err != nil {
+		channel, err = s.Channel(channelID)
+		if err != nil {
+			logrus.Warnf("Could not look up channel %s: %s", channelID, err)
+			return discordUploadLimit
+		}
+	}
+	return guildUploadLimit(s, channel.GuildID)
+}
+
+// guildUploadLimit returns the largest attachment, in bytes, that can be
+// posted to the guild. Direct messages and unknown guilds get Discord's
+// default limit.
+func guildUploadLimit(s *discordgo.Session, guildID string) int {
+	if guildID == "" {
+		return discordUploadLimit
+	}
+
+	guild, err := s.State.Guild(guildID)
+	if err != nil {
+		guild, err = s.Guild(guildID)
+		if err != nil {
+			logrus.Warnf("Could not look up guild %s: %s", guildID, err)
+			return discordUploadLimit
+		}
+	}
+
+	switch guild.PremiumTier {
+	case discordgo.PremiumTier2:
+		return 50 << 20
+	case discordgo.PremiumTier3:
+		return 100 << 20
+	default:
+		return discordUploadLimit
 	}
 }
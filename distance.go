@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DiagonalRule selects how diagonal movement is counted on square grids.
+type DiagonalRule string
+
+// The values match the diagonaltype setting of roll20 pages.
+const (
+	Diagonal5e        DiagonalRule = "foure"
+	Diagonal51015     DiagonalRule = "threefive"
+	DiagonalEuclidean DiagonalRule = "pythagorean"
+	DiagonalManhattan DiagonalRule = "manhattan"
+)
+
+var diagonalRuleNames = map[DiagonalRule]string{
+	Diagonal5e:        "5e",
+	Diagonal51015:     "5-10-5",
+	DiagonalEuclidean: "Euclidean",
+	DiagonalManhattan: "Manhattan",
+}
+
+func (d DiagonalRule) String() string {
+	if name, ok := diagonalRuleNames[d]; ok {
+		return name
+	}
+	return string(d)
+}
+
+var cellPattern = regexp.MustCompile(`^([A-Za-z]+)([0-9]+)$`)
+
+// parseGridCell parses a cell in the format produced by GridCell.String.
+func parseGridCell(s string) (GridCell, bool) {
+	match := cellPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return GridCell{}, false
+	}
+
+	column := 0
+	for _, c := range strings.ToUpper(match[1]) {
+		column = column*26 + int(c-'A') + 1
+	}
+	row, err := strconv.Atoi(match[2])
+	if err != nil || row < 1 {
+		return GridCell{}, false
+	}
+	return GridCell{Column: column - 1, Row: row - 1}, true
+}
+
+// Location is a named position on a page, in page pixel coordinates.
+type Location struct {
+	Name string
+	X, Y float64
+}
+
+// ResolveLocation finds a token by name or, failing that, parses a grid
+// cell such as "C7".
+func (p *PageData) ResolveLocation(s string) (Location, error) {
+	if token, err := p.FindToken(s); err == nil {
+		return Location{
+			Name: fmt.Sprintf("%s (%s)", token.Name, token.Cell(p)),
+			X:    token.Left,
+			Y:    token.Top,
+		}, nil
+	}
+
+	cell, ok := parseGridCell(s)
+	if !ok {
+		return Location{}, fmt.Errorf("%q is neither a token on the active page nor a grid cell", s)
+	}
+	grid := p.GridSize()
+	return Location{
+		Name: cell.String(),
+		X:    (float64(cell.Column) + 0.5) * grid,
+		Y:    (float64(cell.Row) + 0.5) * grid,
+	}, nil
+}
+
+// Distance is a measurement between two locations.
+type Distance struct {
+	Cells float64
+	Value float64
+	Units string
+	Rule  DiagonalRule
+}
+
+func (d Distance) String() string {
+	return fmt.Sprintf("%s %s", strconv.FormatFloat(d.Value, 'f', -1, 64), d.Units)
+}
+
+// Measure returns the distance between two locations using the page's grid
+// type and scale. If rule is empty, the page's own diagonal rule is used.
+func (p *PageData) Measure(from, to Location, rule DiagonalRule) Distance {
+	if rule == "" {
+		rule = DiagonalRule(p.Page.DiagonalType)
+	}
+
+	grid := p.GridSize()
+	var cells float64
+	switch {
+	case p.Gridless():
+		rule = DiagonalEuclidean
+		cells = math.Hypot(to.X-from.X, to.Y-from.Y) / grid
+	case p.Page.GridType == "hex" || p.Page.GridType == "hexr":
+		// every step on a hex grid costs the same, so there is no diagonal rule
+		rule = ""
+		cells = float64(hexDistance(from, to, grid, p.Page.GridType == "hexr"))
+	default:
+		dx := math.Abs(math.Floor(to.X/grid) - math.Floor(from.X/grid))
+		dy := math.Abs(math.Floor(to.Y/grid) - math.Floor(from.Y/grid))
+		cells = squareDistance(dx, dy, rule)
+	}
+
+	// round to two decimal places so Euclidean results stay readable
+	value := math.Round(cells*p.Page.ScaleNumber*100) / 100
+	return Distance{
+		Cells: cells,
+		Value: value,
+		Units: p.Page.ScaleUnits,
+		Rule:  rule,
+	}
+}
+
+// squareDistance counts the squares between two cells dx and dy squares apart.
+func squareDistance(dx, dy float64, rule DiagonalRule) float64 {
+	long, short := math.Max(dx, dy), math.Min(dx, dy)
+	switch rule {
+	case Diagonal51015:
+		// every second diagonal costs double
+		return long + math.Floor(short/2)
+	case DiagonalEuclidean:
+		return math.Round(math.Hypot(dx, dy)*100) / 100
+	case DiagonalManhattan:
+		return dx + dy
+	default:
+		return long
+	}
+}
+
+// hexDistance counts the hexes between two locations. Vertical hex grids
+// ("hex") have flat tops and horizontal grids ("hexr") pointed tops, with
+// adjacent hex centers one grid unit apart.
+func hexDistance(from, to Location, grid float64, pointy bool) int {
+	aq, ar := pixelToHex(from.X, from.Y, grid, pointy)
+	bq, br := pixelToHex(to.X, to.Y, grid, pointy)
+	dq, dr := aq-bq, ar-br
+	return (abs(dq) + abs(dr) + abs(dq+dr)) / 2
+}
+
+// pixelToHex converts pixel coordinates to axial hex coordinates.
+func pixelToHex(x, y, grid float64, pointy bool) (int, int) {
+	// size is the distance from a hex's center to its corners
+	size := grid / math.Sqrt(3)
+	var q, r float64
+	if pointy {
+		q = (math.Sqrt(3)/3*x - y/3) / size
+		r = (2.0 / 3 * y) / size
+	} else {
+		q = (2.0 / 3 * x) / size
+		r = (-x/3 + math.Sqrt(3)/3*y) / size
+	}
+
+	// round in cube coordinates to find the containing hex
+	s := -q - r
+	rq, rr, rs := math.Round(q), math.Round(r), math.Round(s)
+	dq, dr, ds := math.Abs(rq-q), math.Abs(rr-r), math.Abs(rs-s)
+	if dq > dr && dq > ds {
+		rq = -rr - rs
+	} else if dr > ds {
+		rr = -rq - rs
+	}
+	return int(rq), int(rr)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
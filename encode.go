@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/nfnt/resize"
+	"github.com/sirupsen/logrus"
+)
+
+type ImageFormat string
+
+const (
+	FormatJPEG ImageFormat = "jpeg"
+	FormatPNG  ImageFormat = "png"
+	// FormatWebP is lossless WebP, which is usually smaller than PNG.
+	FormatWebP ImageFormat = "webp"
+)
+
+var imageFormatExtensions = map[ImageFormat]string{
+	FormatJPEG: "jpg",
+	FormatPNG:  "png",
+	FormatWebP: "webp",
+}
+
+const (
+	// minQuality is the lowest JPEG quality used to fit the upload limit.
+	minQuality = 30
+	// qualityStep is how much the JPEG quality is lowered by on each attempt.
+	qualityStep = 10
+	// minFitWidth is the narrowest an image is resized to to fit the upload
+	// limit.
+	minFitWidth = 200
+)
+
+func parseImageFormat(s string) (ImageFormat, error) {
+	format := ImageFormat(strings.ToLower(s))
+	if format == "jpg" {
+		format = FormatJPEG
+	}
+	if _, ok := imageFormatExtensions[format]; !ok {
+		return "", fmt.Errorf("unknown image format %q", s)
+	}
+	return format, nil
+}
+
+// OutputOptions controls how maps are encoded for posting.
+type OutputOptions struct {
+	Format ImageFormat
+	// Quality is the JPEG quality, from 1 to 100.
+	Quality int
+	// MaxBytes is the largest allowed size of an encoded map. Zero means
+	// Discord's default upload limit.
+	MaxBytes int
+}
+
+// encodedImage is an image ready to be attached to a Discord message.
+type encodedImage struct {
+	data   []byte
+	format ImageFormat
+	// notes describe what was done to fit the upload limit, if anything.
+	notes []string
+}
+
+func (e *encodedImage) Reader() io.Reader {
+	return bytes.NewReader(e.data)
+}
+
+// FileName returns a file name for the image with the extension of its format.
+func (e *encodedImage) FileName(base string) string {
+	return fmt.Sprintf("%s.%s", base, imageFormatExtensions[e.format])
+}
+
+// Note returns a message describing any reductions made to the image.
+func (e *encodedImage) Note() string {
+	if len(e.notes) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Map %s to fit Discord's upload limit", strings.Join(e.notes, " and "))
+}
+
+func encodeImageFormat(img image.Image, format ImageFormat, quality int) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var err error
+	switch format {
+	case FormatPNG:
+		err = png.Encode(buf, img)
+	case FormatWebP:
+		err = nativewebp.Encode(buf, img, nil)
+	default:
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encode image as %s: %w", format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeImage encodes the image in the configured format. If the result is
+// larger than limit bytes, JPEG quality is lowered first and then the image
+// is scaled down until it fits.
+func encodeImage(img image.Image, opts OutputOptions, limit int) (*encodedImage, error) {
+	quality := opts.Quality
+	if quality <= 0 || quality > 100 {
+		quality = jpeg.DefaultQuality
+	}
+	startQuality := quality
+
+	result := &encodedImage{format: opts.Format}
+	data, err := encodeImageFormat(img, opts.Format, quality)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Format == FormatJPEG {
+		for len(data) > limit && quality-qualityStep >= minQuality {
+			quality -= qualityStep
+			logrus.Printf("Encoded image is %d bytes, lowering quality to %d", len(data), quality)
+			data, err = encodeImageFormat(img, opts.Format, quality)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if quality != startQuality {
+			result.notes = append(result.notes, fmt.Sprintf("compressed to quality %d", quality))
+		}
+	}
+
+	width := img.Bounds().Dx()
+	for len(data) > limit {
+		width = width * 3 / 4
+		if width < minFitWidth {
+			return nil, fmt.Errorf("image is too large to upload even when scaled down")
+		}
+		logrus.Printf("Encoded image is %d bytes, resizing to width %d", len(data), width)
+		data, err = encodeImageFormat(resize.Resize(uint(width), 0, img, resize.Lanczos3), opts.Format, quality)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if width != img.Bounds().Dx() {
+		result.notes = append(result.notes, fmt.Sprintf("scaled down to %dpx wide", width))
+	}
+
+	result.data = data
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxStatusLength is Discord's message length limit, which the statuses of
+// all games share.
+const maxStatusLength = 2000
+
+// maxStatusErrorLength keeps a long error, such as a Playwright call log,
+// from filling the status of a game.
+const maxStatusErrorLength = 300
+
+// BrowserState is what a Roll20Browser is doing.
+type BrowserState string
+
+const (
+	StateStarting    BrowserState = "starting"
+	StateLoggingIn   BrowserState = "logging_in"
+	StateLoadingGame BrowserState = "loading_game"
+	StateReady       BrowserState = "ready"
+	StateCapturing   BrowserState = "capturing"
+	StateRelaunching BrowserState = "relaunching"
+	StateFailed      BrowserState = "failed"
+)
+
+// Health is a snapshot of the state of a Roll20Browser.
+type Health struct {
+	Game  string
+	State BrowserState
+	// Since is when the browser entered its state.
+	Since time.Time
+
+	LastError     string
+	LastErrorTime time.Time
+	// LastMap and LastSheets are when the map and the character sheets
+	// were last captured successfully.
+	LastMap    time.Time
+	LastSheets time.Time
+	Relaunches int
+
+	Queue QueueStatus
+}
+
+// healthTracker records the health of a Roll20Browser. It is updated by
+// jobs and read by commands, so it has its own lock.
+type healthTracker struct {
+	lock   sync.Mutex
+	health Health
+}
+
+func (t *healthTracker) set(update func(h *Health)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	update(&t.health)
+}
+
+func (r *Roll20Browser) setState(state BrowserState) {
+	r.health.set(func(h *Health) {
+		if h.State != state {
+			h.State = state
+			h.Since = time.Now()
+		}
+	})
+}
+
+// fail records err and marks the browser as failed until the next
+// successful operation or relaunch.
+func (r *Roll20Browser) fail(err error) {
+	r.health.set(func(h *Health) {
+		h.State = StateFailed
+		h.Since = time.Now()
+		h.LastError = err.Error()
+		h.LastErrorTime = h.Since
+	})
+}
+
+// Health returns the current state of the browser.
+func (r *Roll20Browser) Health() Health {
+	r.health.lock.Lock()
+	health := r.health.health
+	r.health.lock.Unlock()
+
+	health.Game = r.game
+	health.Queue = r.QueueStatus()
+	return health
+}
+
+// Describe formats the health for Discord.
+func (h Health) Describe() string {
+	lines := []string{
+		fmt.Sprintf("**%s**: %s since %s", h.Game, h.State, discordTime(h.Since)),
+		fmt.Sprintf("Last map: %s, last sheets: %s, relaunches: %d", discordTime(h.LastMap), discordTime(h.LastSheets), h.Relaunches),
+	}
+
+	queue := fmt.Sprintf("Queue: %d waiting", h.Queue.Depth)
+	if h.Queue.Depth > 0 {
+		queue += fmt.Sprintf(" for up to %s", h.Queue.OldestWait.Round(time.Second))
+	}
+	if h.Queue.Running != "" {
+		queue += fmt.Sprintf(", running %s", h.Queue.Running)
+	}
+	lines = append(lines, queue)
+
+	if h.LastError != "" {
+		lastError := h.LastError
+		if runes := []rune(lastError); len(runes) > maxStatusErrorLength {
+			lastError = string(runes[:maxStatusErrorLength]) + "…"
+		}
+		lines = append(lines, fmt.Sprintf("Last error %s: %s", discordTime(h.LastErrorTime), lastError))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// describeAll formats the health of several games for a single Discord
+// message. Games that do not fit are left out.
+func describeAll(healths []Health) string {
+	var statuses []string
+	for _, h := range healths {
+		statuses = append(statuses, h.Describe())
+	}
+
+	for n := len(statuses); n > 0; n-- {
+		content := strings.Join(statuses[:n], "\n\n")
+		if n < len(statuses) {
+			content += fmt.Sprintf("\n\n... and %d more games", len(statuses)-n)
+		}
+		if utf8.RuneCountInString(content) <= maxStatusLength {
+			return content
+		}
+	}
+	return fmt.Sprintf("%d games, too many to describe", len(statuses))
+}
+
+// discordTime formats t as a relative Discord timestamp.
+func discordTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("<t:%d:R>", t.Unix())
+}
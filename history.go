@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxHistoryEntries is the number of captures listed by /maphistory.
+const maxHistoryEntries = 20
+
+// archiveMapHandler returns a handler that saves every map capture to the
+// archive.
+func archiveMapHandler(archive *MapArchive) func(*mapCapture) {
+	return func(capture *mapCapture) {
+		err := archive.Save(capture)
+		if err != nil {
+			logrus.Errorf("Error archiving map: %s", err)
+		}
+	}
+}
+
+// getArchive returns the map archive of a roll20 instance.
+func (app *Application) getArchive(r20 *Roll20Browser) (*MapArchive, error) {
+	archive, ok := app.Archives[r20]
+	if !ok {
+		return nil, fmt.Errorf("map history is not enabled")
+	}
+	return archive, nil
+}
+
+// GetArchivedMap returns the map as it was at the time described by query,
+// along with the time it was captured. The map is encoded to fit in the
+// given upload limit.
+func (app *Application) GetArchivedMap(r20 *Roll20Browser, query string, limit int) (*encodedImage, time.Time, error) {
+	archive, err := app.getArchive(r20)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	t, err := parseTimeQuery(query, time.Now().In(app.location))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	snapshot, err := archive.At(t)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	img, err := snapshot.Load()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	encoded, err := r20.encodeMap(img, limit)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return encoded, snapshot.Time, nil
+}
+
+// GetMapHistory returns a list of the most recent archived captures.
+func (app *Application) GetMapHistory(r20 *Roll20Browser) (string, error) {
+	archive, err := app.getArchive(r20)
+	if err != nil {
+		return "", err
+	}
+
+	snapshots, err := archive.List()
+	if err != nil {
+		return "", err
+	}
+	if len(snapshots) == 0 {
+		return "No maps archived yet", nil
+	}
+
+	var lines []string
+	for i, snapshot := range snapshots {
+		if i == maxHistoryEntries {
+			lines = append(lines, fmt.Sprintf("... and %d older", len(snapshots)-i))
+			break
+		}
+		// Discord renders these timestamps in each user's own time zone
+		lines = append(lines, fmt.Sprintf("<t:%d:T> <t:%d:R> %s", snapshot.Time.Unix(), snapshot.Time.Unix(), snapshot.Page))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// GetTimelapse renders the archived maps between two times, described the
+// same way as for /map at, as an animated GIF no larger than limit bytes.
+func (app *Application) GetTimelapse(r20 *Roll20Browser, from, to, page string, limit int) (io.Reader, int, error) {
+	archive, err := app.getArchive(r20)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now().In(app.location)
+	opts := TimelapseOptions{Page: page, MaxBytes: limit}
+	opts.From, err = parseTimeQuery(from, now)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts.To, err = parseTimeQuery(to, now)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	anim, frames, err := BuildTimelapse(archive, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(anim), frames, nil
+}
+
+// GetMapDiff highlights the changes between the current map and either the
+// previous different capture or, when query is set, the map archived at
+// that time. It returns the highlighted map and a description of the
+// comparison.
+func (app *Application) GetMapDiff(r20 *Roll20Browser, query string, limit int) (*encodedImage, string, error) {
+	current := r20.getMapCapture()
+	if current == nil {
+		return nil, "", r20.mapNotReady()
+	}
+
+	var before image.Image
+	var since time.Time
+	if query == "" {
+		previous := r20.getPreviousMapCapture()
+		if previous == nil {
+			return nil, "", fmt.Errorf("map has not changed since the bot started")
+		}
+		before, since = previous.full, previous.time
+	} else {
+		archive, err := app.getArchive(r20)
+		if err != nil {
+			return nil, "", err
+		}
+		t, err := parseTimeQuery(query, time.Now().In(app.location))
+		if err != nil {
+			return nil, "", err
+		}
+		snapshot, err := archive.At(t)
+		if err != nil {
+			return nil, "", err
+		}
+		before, err = snapshot.Load()
+		if err != nil {
+			return nil, "", err
+		}
+		since = snapshot.Time
+	}
+
+	img, changed := highlightChanges(before, current.full, uint8(app.DiffTolerance))
+	encoded, err := r20.encodeMap(img, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	description := fmt.Sprintf("%.1f%% of the map changed since <t:%d:T>", changed*100, since.Unix())
+	return encoded, description, nil
+}
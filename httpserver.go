@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// httpShutdownTimeout is how long open HTTP requests get to finish when
+// the application closes.
+const httpShutdownTimeout = 5 * time.Second
+
+// healthcheckTimeout bounds the request made by the healthcheck command.
+const healthcheckTimeout = 10 * time.Second
+
+// instanceStatus is the state of a Roll20Browser as served by /status.json.
+type instanceStatus struct {
+	Game          string       `json:"game"`
+	State         BrowserState `json:"state"`
+	Since         time.Time    `json:"since"`
+	LastError     string       `json:"last_error,omitempty"`
+	LastErrorTime *time.Time   `json:"last_error_time,omitempty"`
+	LastMap       *time.Time   `json:"last_map,omitempty"`
+	LastSheets    *time.Time   `json:"last_sheets,omitempty"`
+	Relaunches    int          `json:"relaunches"`
+	QueueDepth    int          `json:"queue_depth"`
+	QueueRunning  JobKind      `json:"queue_running,omitempty"`
+	// QueueOldestWait is in seconds.
+	QueueOldestWait float64 `json:"queue_oldest_wait"`
+}
+
+// optionalTime returns nil for the zero time, so that it is left out of
+// JSON.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newInstanceStatus(h Health) instanceStatus {
+	return instanceStatus{
+		Game:            h.Game,
+		State:           h.State,
+		Since:           h.Since,
+		LastError:       h.LastError,
+		LastErrorTime:   optionalTime(h.LastErrorTime),
+		LastMap:         optionalTime(h.LastMap),
+		LastSheets:      optionalTime(h.LastSheets),
+		Relaunches:      h.Relaunches,
+		QueueDepth:      h.Queue.Depth,
+		QueueRunning:    h.Queue.Running,
+		QueueOldestWait: h.Queue.OldestWait.Seconds(),
+	}
+}
+
+// startHTTPServer serves the health endpoints and metrics on HTTPAddress,
+// if set. The address is bound right away, so that a bad address fails the
+// launch.
+func (app *Application) startHTTPServer() error {
+	if app.HTTPAddress == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", app.handleHealthz)
+	mux.HandleFunc("/readyz", app.handleReadyz)
+	mux.HandleFunc("/status.json", app.handleStatus)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	err := prometheus.Register(instanceCollector{instances: app.Roll20Instances})
+	if err != nil {
+		return fmt.Errorf("could not register metrics: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", app.HTTPAddress)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", app.HTTPAddress, err)
+	}
+	app.httpServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	logrus.Printf("Serving HTTP on %s", listener.Addr())
+	go func() {
+		err := app.httpServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("Error serving HTTP: %s", err)
+		}
+	}()
+	return nil
+}
+
+// closeHTTPServer stops the HTTP server, waiting briefly for open requests.
+func (app *Application) closeHTTPServer() {
+	if app.httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := app.httpServer.Shutdown(ctx); err != nil {
+		logrus.Errorf("Error closing HTTP server: %s", err)
+	}
+}
+
+// handleHealthz reports that the process is alive.
+func (app *Application) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the bot can answer commands: the Discord
+// gateway is connected and every game has a recent map.
+func (app *Application) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	reasons := app.notReady()
+	if len(reasons) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(reasons, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// notReady returns why the bot is not ready, or nothing if it is.
+func (app *Application) notReady() []string {
+	var reasons []string
+
+	app.handlerLock.Lock()
+	shuttingDown := app.shuttingDown
+	app.handlerLock.Unlock()
+	if shuttingDown {
+		reasons = append(reasons, "shutting down")
+	}
+
+	if !app.Discord.Connected() {
+		reasons = append(reasons, "discord: not connected")
+	}
+
+	maxAge := time.Duration(app.ReadyMapAge) * time.Second
+	for _, r20 := range app.Roll20Instances {
+		health := r20.Health()
+		if health.LastMap.IsZero() {
+			reasons = append(reasons, fmt.Sprintf("%s: no map captured yet", health.Game))
+		} else if age := time.Since(health.LastMap); age > maxAge {
+			reasons = append(reasons, fmt.Sprintf("%s: map is %s old", health.Game, age.Round(time.Second)))
+		}
+	}
+	return reasons
+}
+
+// handleStatus serves the state of every game as JSON.
+func (app *Application) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Ready     bool             `json:"ready"`
+		Discord   bool             `json:"discord_connected"`
+		InFlight  int              `json:"commands_in_flight"`
+		Instances []instanceStatus `json:"instances"`
+	}{
+		Ready:     len(app.notReady()) == 0,
+		Discord:   app.Discord.Connected(),
+		InFlight:  app.InFlight(),
+		Instances: []instanceStatus{},
+	}
+	for _, r20 := range app.Roll20Instances {
+		status.Instances = append(status.Instances, newInstanceStatus(r20.Health()))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(status); err != nil {
+		logrus.Errorf("Error writing status: %s", err)
+	}
+}
+
+// checkReady asks the HTTP server of a running bot, listening on address,
+// whether it is ready. It is used by the healthcheck command, which runs
+// as a separate process in the same container.
+func checkReady(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid http address %q: %w", address, err)
+	}
+	// a server listening on every interface is reached through localhost
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	client := http.Client{Timeout: healthcheckTimeout}
+	resp, err := client.Get(fmt.Sprintf("http://%s/readyz", net.JoinHostPort(host, port)))
+	if err != nil {
+		return fmt.Errorf("could not reach http server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("not ready: %s", strings.Join(strings.Fields(string(body)), " "))
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/sirupsen/logrus"
+)
+
+// liveChannel tracks the maps posted to a channel in live mode.
+type liveChannel struct {
+	lastPosted   *mapCapture
+	lastPostTime time.Time
+}
+
+// liveMap tracks the pinned message of a channel's live map.
+type liveMap struct {
+	messageID  string
+	lastPosted *mapCapture
+}
+
+// loadLiveState restores the live channels and live maps saved in the
+// application state.
+func (app *Application) loadLiveState() {
+	app.liveLock.Lock()
+	defer app.liveLock.Unlock()
+
+	for _, channelID := range app.State.LiveChannels() {
+		app.liveChannels[channelID] = &liveChannel{}
+	}
+	for channelID, messageID := range app.State.LiveMaps() {
+		app.liveMaps[channelID] = &liveMap{messageID: messageID}
+	}
+}
+
+// SetLive turns live mode on or off for a channel. When turning live mode
+// on, current is the map already shown to the channel, if any.
+func (app *Application) SetLive(channelID string, enabled bool, current *mapCapture) error {
+	app.liveLock.Lock()
+	defer app.liveLock.Unlock()
+
+	if !enabled {
+		delete(app.liveChannels, channelID)
+	} else {
+		live := &liveChannel{lastPosted: current}
+		if current != nil {
+			live.lastPostTime = time.Now()
+		}
+		app.liveChannels[channelID] = live
+	}
+	return app.State.SetLiveChannel(channelID, enabled)
+}
+
+// StartLiveMap posts and pins a new live map message in the channel,
+// replacing any previous live map of the channel.
+func (app *Application) StartLiveMap(channelID string, capture *mapCapture) error {
+	session := app.Discord.Session()
+
+	app.liveLock.Lock()
+	old, replacing := app.liveMaps[channelID]
+	app.liveLock.Unlock()
+
+	if replacing {
+		err := session.ChannelMessageUnpin(channelID, old.messageID)
+		if err != nil {
+			logrus.Warnf("Could not unpin previous live map: %s", err)
+		}
+	}
+
+	picture, err := app.fitLiveMap(session, channelID, capture)
+	if err != nil {
+		return err
+	}
+	messageID, err := app.postLiveMap(session, channelID, picture)
+	if err != nil {
+		return err
+	}
+
+	app.liveLock.Lock()
+	defer app.liveLock.Unlock()
+	app.liveMaps[channelID] = &liveMap{messageID: messageID, lastPosted: capture}
+	return app.State.SetLiveMap(channelID, messageID)
+}
+
+// StopLiveMap unpins the channel's live map and stops updating it.
+func (app *Application) StopLiveMap(channelID string) error {
+	session := app.Discord.Session()
+
+	app.liveLock.Lock()
+	live, ok := app.liveMaps[channelID]
+	delete(app.liveMaps, channelID)
+	app.liveLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	err := session.ChannelMessageUnpin(channelID, live.messageID)
+	if err != nil {
+		logrus.Warnf("Could not unpin live map: %s", err)
+	}
+	return app.State.SetLiveMap(channelID, "")
+}
+
+// fitLiveMap encodes the capture to fit the upload limit of the channel.
+func (app *Application) fitLiveMap(session *discordgo.Session, channelID string, capture *mapCapture) (*encodedImage, error) {
+	r20, ok := app.Roll20ChannelMap[channelID]
+	if !ok {
+		return nil, fmt.Errorf("channel %s is untracked", channelID)
+	}
+	return r20.fitMap(capture, channelUploadLimit(session, channelID))
+}
+
+// postLiveMap sends a new live map message and pins it, returning the ID of
+// the message.
+func (app *Application) postLiveMap(session *discordgo.Session, channelID string, picture *encodedImage) (string, error) {
+	msg, err := session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Files: []*discordgo.File{
+			{Name: picture.FileName("map"), Reader: picture.Reader()},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not post live map: %w", err)
+	}
+
+	err = session.ChannelMessagePin(channelID, msg.ID)
+	if err != nil {
+		// the map is still updated when it cannot be pinned
+		logrus.Warnf("Could not pin live map: %s", err)
+	}
+	return msg.ID, nil
+}
+
+// updateLiveMap replaces the attachment of the live map message, posting a
+// new message if the old one was deleted. It returns the ID of the message
+// now showing the live map.
+func (app *Application) updateLiveMap(session *discordgo.Session, channelID, messageID string, picture *encodedImage) (string, error) {
+	_, err := session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:          messageID,
+		Channel:     channelID,
+		Attachments: &[]*discordgo.MessageAttachment{},
+		Files: []*discordgo.File{
+			{Name: picture.FileName("map"), Reader: picture.Reader()},
+		},
+	})
+
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMessage {
+		logrus.Printf("Live map in channel %s was deleted, posting a new one", channelID)
+		return app.postLiveMap(session, channelID, picture)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not edit live map: %w", err)
+	}
+	return messageID, nil
+}
+
+// liveTarget is a live channel or live map to update with a new capture.
+// Targets are copied out of the live state so that Discord is called
+// without holding the lock.
+type liveTarget struct {
+	channelID string
+	// messageID is the live map message, empty for live channels.
+	messageID  string
+	lastPosted *mapCapture
+}
+
+// liveTargets returns the live channels due for a post and the live maps
+// tracking the given roll20 instance.
+func (app *Application) liveTargets(r20 *Roll20Browser) (channels, maps []liveTarget) {
+	app.liveLock.Lock()
+	defer app.liveLock.Unlock()
+
+	for channelID, live := range app.liveChannels {
+		if app.Roll20ChannelMap[channelID] != r20 {
+			continue
+		}
+		if time.Since(live.lastPostTime) < time.Duration(app.LiveInterval)*time.Second {
+			continue
+		}
+		channels = append(channels, liveTarget{channelID: channelID, lastPosted: live.lastPosted})
+	}
+	for channelID, live := range app.liveMaps {
+		if app.Roll20ChannelMap[channelID] != r20 {
+			continue
+		}
+		maps = append(maps, liveTarget{channelID: channelID, messageID: live.messageID, lastPosted: live.lastPosted})
+	}
+	return channels, maps
+}
+
+// liveMapHandler returns a handler that posts changed maps to the live
+// channels and updates the live maps tracking the given roll20 instance.
+func (app *Application) liveMapHandler(r20 *Roll20Browser) func(*mapCapture) {
+	return func(capture *mapCapture) {
+		session := app.Discord.Session()
+		if session == nil {
+			return
+		}
+
+		channels, maps := app.liveTargets(r20)
+
+		for _, target := range channels {
+			// compare against the last posted map rather than the last capture, so
+			// changes made while waiting out the interval are still posted
+			if target.lastPosted != nil {
+				difference := mapDifference(target.lastPosted.full, capture.full)
+				if difference < app.LiveThreshold {
+					continue
+				}
+				logrus.Printf("Map changed by %.2f%%, posting to live channel %s", difference*100, target.channelID)
+			}
+
+			picture, err := r20.fitMap(capture, channelUploadLimit(session, target.channelID))
+			if err != nil {
+				logrus.Errorf("Cannot encode live map: %s", err)
+				continue
+			}
+			_, err = session.ChannelMessageSendComplex(target.channelID, &discordgo.MessageSend{
+				Files: []*discordgo.File{
+					{Name: picture.FileName("map"), Reader: picture.Reader()},
+				},
+			})
+			if err != nil {
+				logrus.Errorf("Cannot post live map: %s", err)
+				continue
+			}
+
+			app.liveLock.Lock()
+			// live mode may have been turned off while posting
+			if live, ok := app.liveChannels[target.channelID]; ok {
+				live.lastPosted = capture
+				live.lastPostTime = time.Now()
+			}
+			app.liveLock.Unlock()
+		}
+
+		for _, target := range maps {
+			if target.lastPosted != nil && mapDifference(target.lastPosted.full, capture.full) < app.LiveThreshold {
+				continue
+			}
+
+			picture, err := r20.fitMap(capture, channelUploadLimit(session, target.channelID))
+			if err != nil {
+				logrus.Errorf("Cannot encode live map: %s", err)
+				continue
+			}
+			messageID, err := app.updateLiveMap(session, target.channelID, target.messageID, picture)
+			if err != nil {
+				logrus.Errorf("Cannot update live map: %s", err)
+				continue
+			}
+			if err := app.setLiveMapPosted(target, messageID, capture); err != nil {
+				logrus.Errorf("Error saving live map: %s", err)
+			}
+		}
+	}
+}
+
+// setLiveMapPosted records that the live map of the target now shows
+// capture in the given message, unless the live map was stopped or
+// restarted while it was updated.
+func (app *Application) setLiveMapPosted(target liveTarget, messageID string, capture *mapCapture) error {
+	app.liveLock.Lock()
+	defer app.liveLock.Unlock()
+
+	live, ok := app.liveMaps[target.channelID]
+	if !ok || live.messageID != target.messageID {
+		return nil
+	}
+	live.lastPosted = capture
+	if messageID == live.messageID {
+		return nil
+	}
+	live.messageID = messageID
+	return app.State.SetLiveMap(target.channelID, messageID)
+}
@@ -7,6 +7,10 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+	// time zones are loaded from the binary, so they work in images without
+	// tzdata
+	_ "time/tzdata"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -65,6 +69,93 @@ func executeCobra() {
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "config file")
 	rootCmd.PersistentFlags().BoolVar(&displaySpec, "spec", false, "display config specification and exit")
 
+	game := ""
+	from := ""
+	to := ""
+	page := ""
+	output := ""
+	maxBytes := 0
+
+	var timelapseCmd = &cobra.Command{
+		Use:   "timelapse",
+		Short: "Export an animated timelapse of archived maps",
+		Run: func(cmd *cobra.Command, args []string) {
+			if configFile == "" {
+				logrus.Fatalf("config file required")
+			}
+
+			config, err := loadConfig(configFile)
+			if err != nil {
+				logrus.Fatalf("could not load config: %s", err)
+			}
+			if config.ArchiveDirectory == "" {
+				logrus.Fatalf("map history is not enabled in config")
+			}
+
+			location, err := time.LoadLocation(config.TimeZone)
+			if err != nil {
+				logrus.Fatalf("invalid time zone: %s", err)
+			}
+			now := time.Now().In(location)
+			opts := TimelapseOptions{Page: page, MaxBytes: maxBytes}
+			opts.From, err = parseTimeQuery(from, now)
+			if err != nil {
+				logrus.Fatalf("invalid start time: %s", err)
+			}
+			opts.To, err = parseTimeQuery(to, now)
+			if err != nil {
+				logrus.Fatalf("invalid end time: %s", err)
+			}
+
+			archive := NewMapArchive(config.ArchiveDirectory, game, 0, 0)
+			anim, frames, err := BuildTimelapse(archive, opts)
+			if err != nil {
+				logrus.Fatalf("could not build timelapse: %s", err)
+			}
+
+			err = os.WriteFile(output, anim, 0644)
+			if err != nil {
+				logrus.Fatalf("could not write timelapse: %s", err)
+			}
+			logrus.Printf("Wrote timelapse of %d frames to %s", frames, output)
+		},
+	}
+
+	timelapseCmd.Flags().StringVar(&game, "game", "", "roll20 game to export")
+	timelapseCmd.Flags().StringVar(&from, "from", "", "start of the timelapse, e.g. \"3h ago\" or \"2006-01-02 19:00\"")
+	timelapseCmd.Flags().StringVar(&to, "to", "now", "end of the timelapse")
+	timelapseCmd.Flags().StringVar(&page, "page", "", "page to export, defaults to the latest page in the time range")
+	timelapseCmd.Flags().StringVarP(&output, "output", "o", "timelapse.gif", "output file")
+	timelapseCmd.Flags().IntVar(&maxBytes, "max-bytes", discordUploadLimit, "maximum size of the output file")
+	timelapseCmd.MarkFlagRequired("game")
+	timelapseCmd.MarkFlagRequired("from")
+	rootCmd.AddCommand(timelapseCmd)
+
+	var healthcheckCmd = &cobra.Command{
+		Use:   "healthcheck",
+		Short: "Check that the running bot is ready, for container health checks",
+		Run: func(cmd *cobra.Command, args []string) {
+			if configFile == "" {
+				logrus.Fatalf("config file required")
+			}
+
+			config, err := loadConfig(configFile)
+			if err != nil {
+				logrus.Fatalf("could not load config: %s", err)
+			}
+			// without the HTTP server there is nothing to check
+			if config.HTTPAddress == "" {
+				return
+			}
+
+			err = checkReady(config.HTTPAddress)
+			if err != nil {
+				logrus.Fatalf("health check failed: %s", err)
+			}
+		},
+	}
+	rootCmd.AddCommand(healthcheckCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of commands, for the commands metric. Commands fail when their
+// handler returns an error, even if the user was told about it.
+const (
+	OutcomeOK       = "ok"
+	OutcomeError    = "error"
+	OutcomeRejected = "rejected"
+	OutcomeUnknown  = "unknown"
+)
+
+// Causes of relaunches, for the relaunches metric.
+const (
+	RelaunchPeriodic   = "periodic"
+	RelaunchMapError   = "map_error"
+	RelaunchSheetError = "sheet_error"
+)
+
+var (
+	commandsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "roll20mapbot_commands_total",
+		Help: "Commands received, by name and outcome.",
+	}, []string{"command", "outcome"})
+	relaunchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "roll20mapbot_relaunches_total",
+		Help: "Relaunches of roll20 browsers, by cause.",
+	}, []string{"game", "cause"})
+	scrapeFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "roll20mapbot_scrape_failures_total",
+		Help: "Failed map captures, by type of failure.",
+	}, []string{"game", "type"})
+
+	// captures take from seconds to minutes
+	captureBuckets = prometheus.ExponentialBuckets(1, 2, 9)
+
+	mapCaptureSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "roll20mapbot_map_capture_seconds",
+		Help:    "Time taken to capture the map in the browser.",
+		Buckets: captureBuckets,
+	}, []string{"game"})
+	sheetCaptureSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "roll20mapbot_sheet_capture_seconds",
+		Help:    "Time taken to print a character sheet in the browser.",
+		Buckets: captureBuckets,
+	}, []string{"game"})
+	imageProcessingSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "roll20mapbot_image_processing_seconds",
+		Help:    "Time taken to crop and encode a captured map.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 9),
+	}, []string{"game"})
+)
+
+func commandOutcome(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeOK
+}
+
+// scrapeFailureType names the kind of a map capture error.
+func scrapeFailureType(err error) string {
+	switch {
+	case errors.Is(err, ErrCanvasTainted):
+		return "canvas_tainted"
+	case errors.Is(err, ErrCanvasMissing):
+		return "canvas_missing"
+	case errors.Is(err, ErrRenderTimeout):
+		return "render_timeout"
+	case errors.Is(err, ErrDownloadTimeout):
+		return "download_timeout"
+	case errors.Is(err, ErrScraperFailed):
+		return "scraper_failed"
+	case errors.Is(err, ErrPageNotActive):
+		return "page_not_active"
+	case errors.Is(err, ErrBrowserClosed):
+		return "browser_closed"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "job_timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "other"
+	}
+}
+
+// observeSince records the time passed since start in a histogram.
+func observeSince(histogram *prometheus.HistogramVec, game string, start time.Time) {
+	histogram.WithLabelValues(game).Observe(time.Since(start).Seconds())
+}
+
+var (
+	mapAgeDesc = prometheus.NewDesc(
+		"roll20mapbot_map_age_seconds",
+		"Time since the cached map was captured.",
+		[]string{"game"}, nil)
+	sheetsAgeDesc = prometheus.NewDesc(
+		"roll20mapbot_sheets_age_seconds",
+		"Time since the cached character sheets were captured.",
+		[]string{"game"}, nil)
+	mapBytesDesc = prometheus.NewDesc(
+		"roll20mapbot_map_bytes",
+		"Size of the cached, encoded map.",
+		[]string{"game"}, nil)
+	queueDepthDesc = prometheus.NewDesc(
+		"roll20mapbot_queue_depth",
+		"Jobs waiting for the browser.",
+		[]string{"game"}, nil)
+)
+
+// instanceCollector reports the gauges of each Roll20Browser when metrics
+// are scraped. Instances without a cached map or sheets have no age.
+type instanceCollector struct {
+	instances []*Roll20Browser
+}
+
+func (c instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mapAgeDesc
+	ch <- sheetsAgeDesc
+	ch <- mapBytesDesc
+	ch <- queueDepthDesc
+}
+
+func (c instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, r20 := range c.instances {
+		health := r20.Health()
+		if !health.LastMap.IsZero() {
+			ch <- prometheus.MustNewConstMetric(mapAgeDesc, prometheus.GaugeValue, time.Since(health.LastMap).Seconds(), r20.game)
+		}
+		if !health.LastSheets.IsZero() {
+			ch <- prometheus.MustNewConstMetric(sheetsAgeDesc, prometheus.GaugeValue, time.Since(health.LastSheets).Seconds(), r20.game)
+		}
+		if capture := r20.getMapCapture(); capture != nil {
+			ch <- prometheus.MustNewConstMetric(mapBytesDesc, prometheus.GaugeValue, float64(len(capture.encoded.data)), r20.game)
+		}
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(health.Queue.Depth), r20.game)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+//go:embed tokens.js
+var tokensScript string
+
+// maxTokenTableLength keeps token tables within Discord's 2000 character
+// message limit, leaving room for the surrounding code block.
+const maxTokenTableLength = 1900
+
+// gridCellSize is the size in pixels of a single grid unit on a roll20
+// page at 100% zoom. Captures at other zoom levels scale it with the zoom.
+const gridCellSize = 70
+
+type PageData struct {
+	Page struct {
+		Name              string  `json:"name"`
+		Width             float64 `json:"width"`
+		Height            float64 `json:"height"`
+		SnappingIncrement float64 `json:"snapping_increment"`
+		GridType          string  `json:"grid_type"`
+		ScaleNumber       float64 `json:"scale_number"`
+		ScaleUnits        string  `json:"scale_units"`
+		DiagonalType      string  `json:"diagonal_type"`
+	} `json:"page"`
+	Tokens []Token `json:"tokens"`
+}
+
+type Token struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	Left          float64    `json:"left"`
+	Top           float64    `json:"top"`
+	Width         float64    `json:"width"`
+	Height        float64    `json:"height"`
+	Bars          []TokenBar `json:"bars"`
+	StatusMarkers []string   `json:"status_markers"`
+}
+
+type TokenBar struct {
+	Value string `json:"value"`
+	Max   string `json:"max"`
+}
+
+func (b TokenBar) String() string {
+	if b.Max == "" {
+		return b.Value
+	}
+	return fmt.Sprintf("%s/%s", b.Value, b.Max)
+}
+
+// parsePageData converts the value returned by evaluating tokensScript
+// into a PageData.
+func parsePageData(result interface{}) (*PageData, error) {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal page data: %w", err)
+	}
+
+	data := &PageData{}
+	err = json.Unmarshal(raw, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal page data: %w", err)
+	}
+	return data, nil
+}
+
+// GridSize returns the size in page pixels of one grid square on the page.
+// Gridless pages report the default size of a grid unit.
+func (p *PageData) GridSize() float64 {
+	if p.Page.SnappingIncrement <= 0 {
+		return gridCellSize
+	}
+	return p.Page.SnappingIncrement * gridCellSize
+}
+
+// Gridless reports whether the page has no snapping grid.
+func (p *PageData) Gridless() bool {
+	return p.Page.SnappingIncrement <= 0
+}
+
+// FindToken returns the token with the given name, ignoring case. Tokens
+// whose name is hidden from players have no name and are never found.
+func (p *PageData) FindToken(name string) (*Token, error) {
+	for i := range p.Tokens {
+		if p.Tokens[i].Name != "" && strings.EqualFold(p.Tokens[i].Name, name) {
+			return &p.Tokens[i], nil
+		}
+	}
+	return nil, fmt.Errorf("token %q is not on the active page", name)
+}
+
+// Center returns the pixel coordinates of the token's center on a map
+// captured at the given scale.
+func (t *Token) Center(scale float64) image.Point {
+	// roll20 stores token positions by their center
+	return image.Pt(int(t.Left*scale), int(t.Top*scale))
+}
+
+// Cell returns the grid cell containing the token's center.
+func (t *Token) Cell(p *PageData) GridCell {
+	grid := p.GridSize()
+	return GridCell{
+		Column: int(t.Left / grid),
+		Row:    int(t.Top / grid),
+	}
+}
+
+// Markers returns the token's status markers without the
+// marker tags roll20 appends after "@".
+func (t *Token) Markers() []string {
+	var markers []string
+	for _, marker := range t.StatusMarkers {
+		markers = append(markers, strings.SplitN(marker, "@", 2)[0])
+	}
+	return markers
+}
+
+// GridCell is a zero-indexed grid square on a page.
+type GridCell struct {
+	Column int
+	Row    int
+}
+
+// String formats the cell the way spreadsheets do, with lettered columns
+// and numbered rows, e.g. "A1" for the top left cell.
+func (c GridCell) String() string {
+	column := ""
+	for n := c.Column + 1; n > 0; n = (n - 1) / 26 {
+		column = string(rune('A'+(n-1)%26)) + column
+	}
+	return fmt.Sprintf("%s%d", column, c.Row+1)
+}
+
+// cropAround crops the provided image to a square centered on the given point
+// and extending radius pixels in each direction. The image is expected to keep
+// the coordinates of the capture, as produced by getVisible.
+func cropAround(img image.Image, center image.Point, radius int) (image.Image, error) {
+	rect := image.Rect(center.X-radius, center.Y-radius, center.X+radius, center.Y+radius).Intersect(img.Bounds())
+	if rect.Empty() {
+		return nil, fmt.Errorf("area around (%d, %d) is outside of the visible map", center.X, center.Y)
+	}
+
+	type subImager interface {
+		SubImage(r image.Rectangle) image.Image
+	}
+
+	sub, ok := img.(subImager)
+	if !ok {
+		return nil, fmt.Errorf("image cannot be cropped")
+	}
+	return sub.SubImage(rect), nil
+}
+
+// formatTokenTable renders the page's tokens as a plain text table sorted
+// by name. Rows that do not fit in a single Discord message are dropped.
+func formatTokenTable(p *PageData) string {
+	if len(p.Tokens) == 0 {
+		return "No tokens on the current page"
+	}
+
+	tokens := make([]Token, len(p.Tokens))
+	copy(tokens, p.Tokens)
+	sort.SliceStable(tokens, func(i, j int) bool {
+		return strings.ToLower(tokens[i].Name) < strings.ToLower(tokens[j].Name)
+	})
+
+	var rows []string
+	for _, token := range tokens {
+		bars := make([]string, 3)
+		for i := range bars {
+			if i < len(token.Bars) {
+				bars[i] = token.Bars[i].String()
+			}
+		}
+		name := token.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		rows = append(rows, strings.Join([]string{
+			name, token.Cell(p).String(), bars[0], bars[1], bars[2], strings.Join(token.Markers(), ", "),
+		}, "\t"))
+	}
+
+	for n := len(rows); n > 0; n-- {
+		buf := new(bytes.Buffer)
+		w := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "Name\tCell\tBar 1\tBar 2\tBar 3\tStatus")
+		for _, row := range rows[:n] {
+			fmt.Fprintln(w, row)
+		}
+		w.Flush()
+		if n < len(rows) {
+			fmt.Fprintf(buf, "... and %d more", len(rows)-n)
+		}
+
+		table := strings.TrimRight(buf.String(), "\n")
+		if len(table) <= maxTokenTableLength {
+			return table
+		}
+	}
+	return fmt.Sprintf("%d tokens on the current page, too many to list", len(rows))
+}
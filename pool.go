@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/playwright-community/playwright-go"
+	"github.com/sirupsen/logrus"
+)
+
+// BrowserPool shares one Playwright runtime and a few browsers between
+// all Roll20Browsers. Each game runs in its own browser context, so games
+// stay isolated while sharing a browser process.
+type BrowserPool struct {
+	headless bool
+	// size is the most browsers launched for each launch configuration.
+	size int
+
+	lock       sync.Mutex
+	playwright *playwright.Playwright
+	browsers   map[string][]*pooledBrowser
+}
+
+type pooledBrowser struct {
+	browser playwright.Browser
+	users   int
+}
+
+// NewBrowserPool creates a pool launching at most size browsers for each
+// launch configuration. Playwright is started on first use.
+func NewBrowserPool(headless bool, size int) *BrowserPool {
+	if size < 1 {
+		size = 1
+	}
+	return &BrowserPool{
+		headless: headless,
+		size:     size,
+		browsers: make(map[string][]*pooledBrowser),
+	}
+}
+
+// poolKey identifies the options a browser was launched with. Options of
+// the browser context, like the proxy, do not matter.
+func poolKey(opts BrowserOptions) string {
+	return strings.Join([]string{
+		opts.Engine,
+		opts.WSEndpoint,
+		opts.CDPEndpoint,
+		strings.Join(opts.Args, " "),
+	}, "|")
+}
+
+// Acquire returns a browser launched with opts. A new browser is started
+// until the pool is full, after which the least used one is shared.
+// Browsers must be given back with Release.
+func (p *BrowserPool) Acquire(opts BrowserOptions) (playwright.Browser, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.playwright == nil {
+		logrus.Printf("Starting playwright")
+		pw, err := playwright.Run()
+		if err != nil {
+			return nil, fmt.Errorf("could not start playwright: %w", err)
+		}
+		p.playwright = pw
+	}
+
+	key := poolKey(opts)
+	p.removeDisconnected(key)
+
+	var least *pooledBrowser
+	for _, pooled := range p.browsers[key] {
+		if least == nil || pooled.users < least.users {
+			least = pooled
+		}
+	}
+	if least == nil || (least.users > 0 && len(p.browsers[key]) < p.size) {
+		logrus.Printf("Starting browser")
+		browser, err := opts.start(p.playwright, p.headless)
+		if err != nil {
+			return nil, err
+		}
+		least = &pooledBrowser{browser: browser}
+		p.browsers[key] = append(p.browsers[key], least)
+	}
+
+	least.users++
+	return least.browser, nil
+}
+
+// Release gives back a browser from Acquire. Browsers are closed once no
+// game uses them.
+func (p *BrowserPool) Release(browser playwright.Browser) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for key, browsers := range p.browsers {
+		for i, pooled := range browsers {
+			if pooled.browser != browser {
+				continue
+			}
+			pooled.users--
+			if pooled.users > 0 {
+				return
+			}
+			logrus.Printf("Closing unused browser")
+			if err := browser.Close(); err != nil {
+				logrus.Error(err)
+			}
+			p.browsers[key] = append(browsers[:i], browsers[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeDisconnected forgets browsers that crashed or lost their
+// connection, so that they are replaced. The lock must be held by the
+// caller.
+func (p *BrowserPool) removeDisconnected(key string) {
+	var connected []*pooledBrowser
+	for _, pooled := range p.browsers[key] {
+		if pooled.browser.IsConnected() {
+			connected = append(connected, pooled)
+		} else {
+			logrus.Printf("Dropping disconnected browser")
+		}
+	}
+	p.browsers[key] = connected
+}
+
+// Close closes all browsers and stops Playwright.
+func (p *BrowserPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for key, browsers := range p.browsers {
+		for _, pooled := range browsers {
+			if err := pooled.browser.Close(); err != nil {
+				logrus.Error(err)
+			}
+		}
+		delete(p.browsers, key)
+	}
+	if p.playwright != nil {
+		if err := p.playwright.Stop(); err != nil {
+			logrus.Error(err)
+		}
+		p.playwright = nil
+	}
+}
@@ -2,17 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
-	"image/png"
 	"io"
 	"os"
 	"path"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nfnt/resize"
@@ -20,6 +21,14 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// sheetPopupTimeout is how long to wait for the printable character sheet
+// to open in headless mode.
+const sheetPopupTimeout = 10 * time.Second
+
+// sheetLoadTimeout is how long to wait for the printable character sheet to
+// finish loading once it opened.
+const sheetLoadTimeout = 30 * time.Second
+
 //go:embed scrape.js
 var scraperScript string
 
@@ -28,96 +37,198 @@ type Roll20Browser struct {
 	password string
 	game     string
 
-	resolution     uint
-	viewportWidth  uint
-	viewportHeight uint
+	Roll20Options
 
-	playwright        *playwright.Playwright
+	pool              *BrowserPool
 	browser           playwright.Browser
+	context           playwright.BrowserContext
 	page              playwright.Page
 	downloadDirectory string
-	lock              *sync.Mutex
-	closed            bool
-
-	cachedImg             []byte
+	queue             *jobQueue
+	closed            atomic.Bool
+
+	// pageLock guards page against the deadlines of jobs, see setPage.
+	pageLock sync.Mutex
+
+	// tracing is set once the trace of the page's context has started,
+	// which is only after logging in.
+	tracing bool
+
+	// ctx is canceled by Close to stop the periodic loops, which are
+	// tracked by loops.
+	ctx    context.Context
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
+
+	// cacheLock guards the caches, which are replaced by the periodic
+	// loops while commands read them.
+	cacheLock             sync.Mutex
+	cachedMap             *mapCapture
+	lastMapError          error
+	previousMap           *mapCapture
 	cachedCharacterSheets map[string][]byte
+
+	mapHandlers []func(*mapCapture)
+	// captures holds the latest capture not yet passed to the map
+	// handlers.
+	captures chan *mapCapture
+
+	health healthTracker
+}
+
+// mapCapture holds the result of a single map capture.
+type mapCapture struct {
+	// full is the visible area of the map at full resolution. It keeps
+	// the pixel coordinates of the original capture, which are page
+	// coordinates multiplied by scale.
+	full    image.Image
+	encoded *encodedImage
+	page    *PageData
+	// scale is the zoom the map was captured at, as a ratio.
+	scale float64
+	time  time.Time
+}
+
+// Roll20Options holds the settings of a Roll20Browser besides its login
+// and game.
+type Roll20Options struct {
+	Resolution     uint
+	ViewportWidth  uint
+	ViewportHeight uint
+	Visible        VisibleOptions
+	Output         OutputOptions
+	Scraper        ScraperOptions
+	// BrowserLogLevel is the lowest level of browser output that is
+	// forwarded to the log.
+	BrowserLogLevel logrus.Level
+	Artifacts       ArtifactOptions
+	Selectors       *SelectorProfile
+	// Headless runs the browser without a display, so neither Xvfb nor
+	// cups-pdf are needed.
+	Headless bool
+	Browser  BrowserOptions
 }
 
-func NewRoll20Browser(email, password, game string, resolution, viewportWidth, viewportHeight uint) *Roll20Browser {
-	return &Roll20Browser{
-		email:          email,
-		password:       password,
-		game:           game,
-		resolution:     resolution,
-		viewportWidth:  viewportWidth,
-		viewportHeight: viewportHeight,
-		lock:           &sync.Mutex{},
+// NewRoll20Browser creates a browser for the game and starts the worker
+// that runs its jobs. Nothing is opened until Launch is called.
+func NewRoll20Browser(pool *BrowserPool, email, password, game string, options Roll20Options) *Roll20Browser {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Roll20Browser{
+		pool:          pool,
+		email:         email,
+		password:      password,
+		game:          game,
+		Roll20Options: options,
+		queue:         newJobQueue(),
+		captures:      make(chan *mapCapture, 1),
+		ctx:           ctx,
+		cancel:        cancel,
 	}
+	r.health.health = Health{State: StateStarting, Since: time.Now()}
+	go r.work()
+	return r
 }
 
-func (r *Roll20Browser) Launch() error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	err := r.launchImpl()
+// OnMapCapture registers a handler to be called after every successful
+// map capture. Handlers must be registered before Launch is called. They
+// run one at a time off the capture loop, and captures made while they
+// are busy are skipped in favor of the latest one.
+func (r *Roll20Browser) OnMapCapture(handler func(*mapCapture)) {
+	r.mapHandlers = append(r.mapHandlers, handler)
+}
+
+// Launch opens the game and fills the caches, giving up when ctx is done.
+// The caches are then refreshed in the background until Close is called.
+func (r *Roll20Browser) Launch(ctx context.Context) error {
+	r.setState(StateStarting)
+	err := r.do(ctx, JobLaunch, PriorityUser, launchTimeout, r.launchImpl)
 	if err != nil {
 		return err
 	}
-	r.periodicGetMap(true)
-	go r.periodicGetMap(false)
-	r.periodicGetCharacterSheets(true)
-	go r.periodicGetCharacterSheets(false)
+	r.periodicGetMap(ctx, true)
+	r.periodicGetCharacterSheets(ctx, true)
+
+	r.loops.Add(3)
+	go func() {
+		defer r.loops.Done()
+		r.runMapHandlers(r.ctx)
+	}()
+	go func() {
+		defer r.loops.Done()
+		r.periodicGetMap(r.ctx, false)
+	}()
+	go func() {
+		defer r.loops.Done()
+		r.periodicGetCharacterSheets(r.ctx, false)
+	}()
 	return nil
 }
 
 // launchImpl contains the implementation of the launch process.
-// This is not inherently thread safe, so a lock must be acquired
-// before this function is called.
-func (r *Roll20Browser) launchImpl() (err error) {
+// This is not inherently thread safe, so it must run as a job.
+func (r *Roll20Browser) launchImpl(ctx context.Context) (err error) {
 	defer func() {
 		if err != nil {
+			r.fail(err)
+			r.saveFailureArtifacts("launch", err)
 			r.closeImpl()
 		}
 	}()
 
-	if r.closed {
+	if r.closed.Load() {
 		return nil
 	}
 
-	// setup playwright and browser
-	logrus.Printf("Starting browser")
-	r.playwright, err = playwright.Run()
-	if err != nil {
-		return fmt.Errorf("could not start playwright: %w", err)
+	// the browser is kept across relaunches unless it disconnected
+	if r.browser != nil && !r.browser.IsConnected() {
+		r.pool.Release(r.browser)
+		r.browser = nil
+	}
+	if r.browser == nil {
+		r.browser, err = r.pool.Acquire(r.Browser)
+		if err != nil {
+			return err
+		}
 	}
 
-	r.browser, err = r.playwright.Chromium.Launch(playwright.BrowserTypeLaunchOptions{
-		Headless: playwright.Bool(false),
-		Args:     []string{"--kiosk-printing"},
-	})
+	// each game gets its own context, isolated from others sharing the
+	// browser
+	r.context, err = r.browser.NewContext(r.contextOptions())
 	if err != nil {
-		return fmt.Errorf("could not launch browser: %w", err)
+		return fmt.Errorf("could not create browser context: %w", err)
 	}
 
 	// navigate to roll20
 	logrus.Printf("Navigating to https://roll20.net")
-	r.page, err = r.browser.NewPage(playwright.BrowserNewContextOptions{
-		AcceptDownloads: playwright.Bool(true),
-		Viewport: &playwright.BrowserNewContextOptionsViewport{
-			Height: playwright.Int(int(r.viewportHeight)),
-			Width:  playwright.Int(int(r.viewportWidth)),
-		},
-	})
+	page, err := r.context.NewPage()
 	if err != nil {
 		return fmt.Errorf("could not create page: %w", err)
 	}
+	r.setPage(page)
+	r.forwardBrowserLogs(r.page)
+	if err = r.checkSelectors(); err != nil {
+		return err
+	}
+	err = r.page.ExposeFunction(scraperProgressBinding, func(args ...interface{}) interface{} {
+		if len(args) > 0 {
+			logrus.Printf("Map capture %v%% done", args[0])
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not expose scraper progress function: %w", err)
+	}
 	if _, err = r.page.Goto("https://roll20.net"); err != nil {
 		return fmt.Errorf("could not goto: %w", err)
 	}
-	time.Sleep(2 * time.Second)
+	if err = sleepContext(ctx, 2*time.Second); err != nil {
+		return err
+	}
 
 	// login to roll20
 	logrus.Printf("Logging in to roll20")
-	dropdown, err := r.page.QuerySelector("#menu-signin")
+	r.setState(StateLoggingIn)
+	dropdown, err := r.page.QuerySelector(r.Selectors.SignInDropdown)
 	if err != nil {
 		return fmt.Errorf("could not find sign in dropdown: %w", err)
 	}
@@ -125,15 +236,15 @@ func (r *Roll20Browser) launchImpl() (err error) {
 	if err != nil {
 		return fmt.Errorf("could not click sign in dropdown: %w", err)
 	}
-	err = r.page.Fill("#input_login-email", r.email)
+	err = r.page.Fill(r.Selectors.LoginEmail, r.email)
 	if err != nil {
 		return fmt.Errorf("could not fill email box: %w", err)
 	}
-	err = r.page.Fill("#input_login-password", r.password)
+	err = r.page.Fill(r.Selectors.LoginPassword, r.password)
 	if err != nil {
 		return fmt.Errorf("could not fill password box: %w", err)
 	}
-	btns, err := r.page.QuerySelectorAll(".btn")
+	btns, err := r.page.QuerySelectorAll(r.Selectors.LoginButtons)
 	if err != nil {
 		return fmt.Errorf("could not find submit button: %w", err)
 	}
@@ -143,7 +254,7 @@ func (r *Roll20Browser) launchImpl() (err error) {
 		if err != nil {
 			return fmt.Errorf("could not read button text: %w", err)
 		}
-		if txt == "Sign in" {
+		if txt == r.Selectors.LoginButtonText {
 			btn.Click()
 			btnClicked = true
 			break
@@ -153,11 +264,17 @@ func (r *Roll20Browser) launchImpl() (err error) {
 	if !btnClicked {
 		return fmt.Errorf("could not find submit button from button candidates")
 	}
-	time.Sleep(2 * time.Second)
+	if err = sleepContext(ctx, 2*time.Second); err != nil {
+		return err
+	}
+	// the trace would record the credentials typed above, so it only
+	// starts once the login page is gone
+	r.startTrace()
 
 	// find desired game
 	logrus.Printf("Finding desired game: %s", r.game)
-	gameLinks, err := r.page.QuerySelectorAll(".listing .gameinfo a:first-child")
+	r.setState(StateLoadingGame)
+	gameLinks, err := r.page.QuerySelectorAll(r.Selectors.GameLinks)
 	if err != nil {
 		return fmt.Errorf("could not load game links: %w", err)
 	}
@@ -189,9 +306,11 @@ func (r *Roll20Browser) launchImpl() (err error) {
 	}
 
 	logrus.Printf("Waiting for roll20 screen to load")
-	time.Sleep(30 * time.Second)
+	if err = sleepContext(ctx, 30*time.Second); err != nil {
+		return err
+	}
 
-	anchors, err := r.page.QuerySelectorAll("a")
+	anchors, err := r.page.QuerySelectorAll(r.Selectors.JournalAnchors)
 	if err != nil {
 		return fmt.Errorf("could not find anchors: %w", err)
 	}
@@ -201,7 +320,7 @@ func (r *Roll20Browser) launchImpl() (err error) {
 		if err != nil {
 			return fmt.Errorf("could not read anchor href: %w", err)
 		}
-		if strings.HasSuffix(txt.String(), "#journal") {
+		if strings.HasSuffix(txt.String(), r.Selectors.JournalAnchorSuffix) {
 			anchor.Click()
 			foundJournalAnchor = true
 			break
@@ -217,31 +336,41 @@ func (r *Roll20Browser) launchImpl() (err error) {
 	}
 
 	logrus.Printf("Browser is ready")
+	r.setState(StateReady)
 	return nil
 }
 
+// Close stops the periodic loops, cancelling their running jobs, and waits
+// for them to exit before closing the browser. Jobs still queued after it
+// fail.
 func (r *Roll20Browser) Close() {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	r.closed = true
-	r.closeImpl()
+	r.closed.Store(true)
+	r.cancel()
+	r.loops.Wait()
+
+	err := r.do(context.Background(), JobClose, PriorityUser, 0, func(ctx context.Context) error {
+		r.closeImpl()
+		if r.browser != nil {
+			r.pool.Release(r.browser)
+			r.browser = nil
+		}
+		r.queue.stop()
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Error closing browser: %s", err)
+	}
 }
 
-// closeImpl contains the implementation of the close process.
-// This is not inherently thread safe, so a lock must be acquired
-// before this function is called.
+// closeImpl contains the implementation of the close process. It closes
+// the game's browser context but keeps the shared browser for relaunches.
+// This is not inherently thread safe, so it must run as a job.
 func (r *Roll20Browser) closeImpl() {
-	if r.browser != nil {
-		if err := r.browser.Close(); err != nil {
+	if r.context != nil {
+		if err := r.context.Close(); err != nil {
 			logrus.Error(err)
 		}
-		r.browser = nil
-	}
-	if r.playwright != nil {
-		if err := r.playwright.Stop(); err != nil {
-			logrus.Error(err)
-		}
-		r.playwright = nil
+		r.context = nil
 	}
 	if r.downloadDirectory != "" {
 		if err := os.RemoveAll(r.downloadDirectory); err != nil {
@@ -249,37 +378,83 @@ func (r *Roll20Browser) closeImpl() {
 		}
 		r.downloadDirectory = ""
 	}
-	r.page = nil
+	r.setPage(nil)
+	r.tracing = false
+}
+
+// setPage replaces the page. The deadline of a job reads the page from
+// another goroutine, so it is set under pageLock; jobs, which are the only
+// ones to set it, read it without the lock.
+func (r *Roll20Browser) setPage(page playwright.Page) {
+	r.pageLock.Lock()
+	r.page = page
+	r.pageLock.Unlock()
+}
+
+// Relaunch reopens the game in a new browser context, giving up when ctx
+// is done. The cause is recorded in the relaunches metric.
+func (r *Roll20Browser) Relaunch(ctx context.Context, cause string) error {
+	return r.do(ctx, JobRelaunch, PriorityUser, launchTimeout, func(ctx context.Context) error {
+		logrus.Printf("Restarting roll20 browser")
+		relaunchesTotal.WithLabelValues(r.game, cause).Inc()
+		r.health.set(func(h *Health) {
+			h.State = StateRelaunching
+			h.Since = time.Now()
+			h.Relaunches++
+		})
+		r.closeImpl()
+		return r.launchImpl(ctx)
+	})
+}
+
+// Errors returned to jobs that cannot use the page.
+var (
+	ErrBrowserClosed = errors.New("browser closed")
+	// ErrPageNotActive means the last launch failed, so there is no page
+	// until the next relaunch.
+	ErrPageNotActive = errors.New("browser page not active")
+)
+
+// checkPage returns an error if the page cannot be used by a job.
+func (r *Roll20Browser) checkPage() error {
+	if r.closed.Load() {
+		return ErrBrowserClosed
+	}
+	if r.page == nil {
+		return ErrPageNotActive
+	}
+	return nil
 }
 
-func (r *Roll20Browser) Relaunch() error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	logrus.Printf("Restarting roll20 browser")
-	r.closeImpl()
-	return r.launchImpl()
+// getCharacterSheets returns the cached character sheets, or nil if they
+// have not been fetched yet. The map is read under the lock but replaced,
+// never modified, so callers can keep using it after the lock is released.
+func (r *Roll20Browser) getCharacterSheets() map[string][]byte {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+	return r.cachedCharacterSheets
 }
 
 func (r *Roll20Browser) ListCharacterSheets() ([]string, error) {
-	if r.cachedCharacterSheets == nil {
+	sheets := r.getCharacterSheets()
+	if sheets == nil {
 		return nil, fmt.Errorf("cached character sheets not yet ready")
 	}
 
 	var names []string
-	for name := range r.cachedCharacterSheets {
+	for name := range sheets {
 		names = append(names, name)
 	}
 	sort.StringSlice(names).Sort()
 	return names, nil
 }
 
-func (r *Roll20Browser) listCharacterSheets(isPreload bool) ([]string, error) {
-	if !isPreload {
-		r.lock.Lock()
-		defer r.lock.Unlock()
+func (r *Roll20Browser) listCharacterSheets() ([]string, error) {
+	if err := r.checkPage(); err != nil {
+		return nil, err
 	}
 
-	journalNames, err := r.page.QuerySelectorAll(".journalitem .name")
+	journalNames, err := r.page.QuerySelectorAll(r.Selectors.JournalNames)
 	if err != nil {
 		return nil, fmt.Errorf("could not find journal names: %w", err)
 	}
@@ -291,7 +466,7 @@ func (r *Roll20Browser) listCharacterSheets(isPreload bool) ([]string, error) {
 			return nil, fmt.Errorf("could not read journal name: %w", err)
 		}
 		txt = strings.Split(txt, "\n")[0]
-		if txt == "Shared Inventory" {
+		if r.Selectors.ignoredJournalName(txt) {
 			continue
 		}
 		names = append(names, strings.TrimSpace(txt))
@@ -301,11 +476,12 @@ func (r *Roll20Browser) listCharacterSheets(isPreload bool) ([]string, error) {
 }
 
 func (r *Roll20Browser) GetCharacterSheet(name string) (io.Reader, error) {
-	if r.cachedCharacterSheets == nil {
+	sheets := r.getCharacterSheets()
+	if sheets == nil {
 		return nil, fmt.Errorf("cached character sheets not yet ready")
 	}
 
-	sheet, ok := r.cachedCharacterSheets[name]
+	sheet, ok := sheets[name]
 	if !ok {
 		return nil, fmt.Errorf("character sheet not found")
 	}
@@ -313,13 +489,25 @@ func (r *Roll20Browser) GetCharacterSheet(name string) (io.Reader, error) {
 	return bytes.NewReader(sheet), nil
 }
 
-func (r *Roll20Browser) getCharacterSheet(name string, isPreload bool) ([]byte, error) {
-	if !isPreload {
-		r.lock.Lock()
-		defer r.lock.Unlock()
+func (r *Roll20Browser) getCharacterSheet(ctx context.Context, name string) (sheet []byte, err error) {
+	if err := r.checkPage(); err != nil {
+		return nil, err
 	}
 
-	journalitems, err := r.page.QuerySelectorAll(".journalitem")
+	r.setState(StateCapturing)
+	r.restartTrace()
+	start := time.Now()
+	defer func() {
+		observeSince(sheetCaptureSeconds, r.game, start)
+		if err != nil {
+			r.fail(err)
+			r.saveFailureArtifacts("sheet", err)
+		} else {
+			r.setState(StateReady)
+		}
+	}()
+
+	journalitems, err := r.page.QuerySelectorAll(r.Selectors.JournalItems)
 	if err != nil {
 		return nil, fmt.Errorf("could not find journal items: %w", err)
 	}
@@ -345,20 +533,52 @@ func (r *Roll20Browser) getCharacterSheet(name string, isPreload bool) ([]byte,
 	}
 
 	// wait for the journal to load
-	time.Sleep(5 * time.Second)
+	if err = sleepContext(ctx, 5*time.Second); err != nil {
+		return nil, err
+	}
 
 	// find print button
-	printBtn, err := r.page.QuerySelector("#printsheet")
+	printBtn, err := r.page.QuerySelector(r.Selectors.PrintSheetButton)
 	if err != nil {
 		return nil, fmt.Errorf("could not find print button: %w", err)
 	}
 
+	if r.Headless {
+		sheet, err = r.renderSheetPDF(ctx, printBtn)
+	} else {
+		sheet, err = r.printSheetPDF(ctx, printBtn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	close, err := r.page.QuerySelector(r.Selectors.CloseDialogButton)
+	if err != nil {
+		return nil, fmt.Errorf("could not find close button: %w", err)
+	}
+	err = close.Click()
+	if err != nil {
+		return nil, fmt.Errorf("could not click close button: %w", err)
+	}
+
+	if err = sleepContext(ctx, 1*time.Second); err != nil {
+		return nil, err
+	}
+
+	return sheet, nil
+}
+
+// printSheetPDF clicks the print button and reads the PDF that the browser
+// prints with cups-pdf, which needs a headed browser with kiosk printing.
+func (r *Roll20Browser) printSheetPDF(ctx context.Context, printBtn playwright.ElementHandle) ([]byte, error) {
 	// click print button
-	err = printBtn.Click()
+	err := printBtn.Click()
 	if err != nil {
 		return nil, fmt.Errorf("could not click print button: %w", err)
 	}
-	time.Sleep(5 * time.Second)
+	if err = sleepContext(ctx, 5*time.Second); err != nil {
+		return nil, err
+	}
 
 	// walk through Downloads dir to find pdf
 	files, err := os.ReadDir(path.Join(os.Getenv("HOME"), "Downloads"))
@@ -385,93 +605,272 @@ func (r *Roll20Browser) getCharacterSheet(name string, isPreload bool) ([]byte,
 		}
 	}
 
-	close, err := r.page.QuerySelector(".ui-icon-closethick")
-	if err != nil {
-		return nil, fmt.Errorf("could not find close button: %w", err)
+	// only chromium prints straight to cups-pdf, other engines leave
+	// nothing behind
+	if buf.Len() == 0 {
+		return nil, fmt.Errorf("no pdf was printed to the downloads dir")
 	}
-	err = close.Click()
+	return buf.Bytes(), nil
+}
+
+// renderSheetPDF clicks the print button and renders the printable sheet
+// it opens to PDF with Playwright, which only works in headless mode. It
+// fails if no popup opens, since rendering the main page would give the
+// editor rather than the sheet.
+func (r *Roll20Browser) renderSheetPDF(ctx context.Context, printBtn playwright.ElementHandle) ([]byte, error) {
+	popups := make(chan playwright.Page, 1)
+	onPopup := func(popup playwright.Page) {
+		select {
+		case popups <- popup:
+		default:
+		}
+	}
+	r.page.On("popup", onPopup)
+	defer r.page.RemoveListener("popup", onPopup)
+
+	err := printBtn.Click()
 	if err != nil {
-		return nil, fmt.Errorf("could not click close button: %w", err)
+		return nil, fmt.Errorf("could not click print button: %w", err)
 	}
 
-	time.Sleep(1 * time.Second)
+	var popup playwright.Page
+	select {
+	case popup = <-popups:
+		defer popup.Close()
+	case <-time.After(sheetPopupTimeout):
+		return nil, fmt.Errorf("print button did not open a popup within %s", sheetPopupTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 
-	return buf.Bytes(), nil
+	// WaitForLoadState neither times out nor reports errors, and waits
+	// forever if the state is never reached, so it is given up on here.
+	// A sheet that did not finish loading would render incomplete.
+	loaded := make(chan struct{})
+	go func() {
+		popup.WaitForLoadState("networkidle")
+		close(loaded)
+	}()
+	select {
+	case <-loaded:
+	case <-time.After(sheetLoadTimeout):
+		return nil, fmt.Errorf("printable sheet did not finish loading within %s", sheetLoadTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// PDFs are rendered with print styles, like the print dialog would
+	pdf, err := popup.PDF(playwright.PagePdfOptions{
+		PrintBackground: playwright.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not render sheet as pdf: %w", err)
+	}
+	return pdf, nil
 }
 
-func (r *Roll20Browser) periodicGetCharacterSheets(isPreload bool) {
+// periodicGetCharacterSheets refreshes the cached character sheets every
+// few minutes, or just once right away if once is set.
+func (r *Roll20Browser) periodicGetCharacterSheets(ctx context.Context, once bool) {
 	sleepDuration := time.Second * 300
-	if !isPreload {
-		time.Sleep(sleepDuration)
+	if !once && sleepContext(ctx, sleepDuration) != nil {
+		return
 	}
 
-	for !r.closed {
+	for ctx.Err() == nil {
 		logrus.Printf("Starting periodic character sheet fetch")
-		names, err := r.listCharacterSheets(isPreload)
+		var names []string
+		err := r.do(ctx, JobListJournal, PrioritySweep, sheetTimeout, func(ctx context.Context) (err error) {
+			names, err = r.listCharacterSheets()
+			return err
+		})
 		if err != nil {
 			logrus.Errorf("Error getting character sheets: %s", err)
-			r.Relaunch()
+			r.Relaunch(ctx, RelaunchSheetError)
 			continue
 		}
 
 		sheets := make(map[string][]byte)
 		for _, name := range names {
 			logrus.Printf("Getting character sheet: %s", name)
-			sheet, err := r.getCharacterSheet(name, isPreload)
+			// one job per sheet, so that other jobs can run in between
+			var sheet []byte
+			err := r.do(ctx, JobCaptureSheet, PrioritySweep, sheetTimeout, func(ctx context.Context) (err error) {
+				sheet, err = r.getCharacterSheet(ctx, name)
+				return err
+			})
+			if ctx.Err() != nil {
+				return
+			}
 			if err != nil {
 				logrus.Errorf("Error getting character sheet: %s", err)
-				r.Relaunch()
+				r.Relaunch(ctx, RelaunchSheetError)
 				continue
 			}
 			sheets[name] = sheet
 		}
 
+		r.cacheLock.Lock()
 		r.cachedCharacterSheets = sheets
+		r.cacheLock.Unlock()
+		r.health.set(func(h *Health) { h.LastSheets = time.Now() })
 		logrus.Printf("Character sheets saved")
 
-		if isPreload {
-			break
+		if once || sleepContext(ctx, sleepDuration) != nil {
+			return
 		}
+	}
+}
 
-		time.Sleep(sleepDuration)
+// GetMap returns the cached map, re-encoded if needed to fit in the given
+// upload limit.
+func (r *Roll20Browser) GetMap(limit int) (*encodedImage, error) {
+	capture := r.getMapCapture()
+	if capture == nil {
+		return nil, r.mapNotReady()
 	}
+	return r.fitMap(capture, limit)
 }
 
-func (r *Roll20Browser) GetMap() (io.Reader, error) {
-	if r.cachedImg == nil {
-		return nil, fmt.Errorf("cached map not yet ready")
+// fitMap returns the encoded capture, encoding it again if it is over the
+// upload limit.
+func (r *Roll20Browser) fitMap(capture *mapCapture, limit int) (*encodedImage, error) {
+	if len(capture.encoded.data) <= r.uploadLimit(limit) {
+		return capture.encoded, nil
 	}
-	return bytes.NewReader(r.cachedImg), nil
+	return r.encodeMap(capture.full, limit)
 }
 
-func (r *Roll20Browser) getMap(isPreload bool) (image.Image, error) {
-	if !isPreload {
-		r.lock.Lock()
-		defer r.lock.Unlock()
+// mapNotReady returns the error for requests made before the map has been
+// captured, including why the last capture failed if it did.
+func (r *Roll20Browser) mapNotReady() error {
+	r.cacheLock.Lock()
+	err := r.lastMapError
+	r.cacheLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("cached map not yet ready, last capture failed: %w", err)
 	}
+	return fmt.Errorf("cached map not yet ready")
+}
+
+// getMapCapture returns the latest map capture, or nil if the map has not
+// been captured yet.
+func (r *Roll20Browser) getMapCapture() *mapCapture {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+	return r.cachedMap
+}
+
+// getPreviousMapCapture returns the last capture that differs from the
+// latest one, or nil if the map has not changed since the bot started.
+func (r *Roll20Browser) getPreviousMapCapture() *mapCapture {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+	return r.previousMap
+}
 
-	if r.closed {
-		return nil, fmt.Errorf("browser closed")
+// GetMapFocus returns the cached map cropped to the area within radius grid
+// squares of the named token.
+func (r *Roll20Browser) GetMapFocus(name string, radius uint, limit int) (*encodedImage, error) {
+	capture := r.getMapCapture()
+	if capture == nil {
+		return nil, r.mapNotReady()
+	}
+	if capture.page == nil {
+		return nil, fmt.Errorf("cached page data not yet ready")
 	}
 
-	if r.page == nil {
-		return nil, fmt.Errorf("browser page not active")
+	token, err := capture.page.FindToken(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// include the token's own square when centering the crop
+	pixels := int((float64(radius) + 0.5) * capture.page.GridSize() * capture.scale)
+	img, err := cropAround(capture.full, token.Center(capture.scale), pixels)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.encodeMap(img, limit)
+}
+
+// GetPageData returns the active page and its tokens as of the last map
+// capture.
+func (r *Roll20Browser) GetPageData() (*PageData, error) {
+	capture := r.getMapCapture()
+	if capture == nil || capture.page == nil {
+		return nil, fmt.Errorf("cached page data not yet ready")
+	}
+	return capture.page, nil
+}
+
+func (r *Roll20Browser) getPageData() (*PageData, error) {
+	if err := r.checkPage(); err != nil {
+		return nil, err
+	}
+
+	logrus.Printf("Evaluating tokens script")
+	result, err := r.page.Evaluate(tokensScript, struct{}{})
+	if err != nil {
+		return nil, fmt.Errorf("could not evaluate tokens script: %w", err)
 	}
 
+	return parsePageData(result)
+}
+
+func (r *Roll20Browser) getMap(ctx context.Context, opts ScraperOptions) (img image.Image, err error) {
+	if err := r.checkPage(); err != nil {
+		scrapeFailuresTotal.WithLabelValues(r.game, scrapeFailureType(err)).Inc()
+		return nil, err
+	}
+
+	r.setState(StateCapturing)
+	r.restartTrace()
+	start := time.Now()
+	defer func() {
+		observeSince(mapCaptureSeconds, r.game, start)
+		if err != nil {
+			scrapeFailuresTotal.WithLabelValues(r.game, scrapeFailureType(err)).Inc()
+			r.fail(err)
+			r.saveFailureArtifacts("map", err)
+		} else {
+			r.setState(StateReady)
+		}
+	}()
+
+	// the download starts before the script resolves, so listen for it first
+	downloads := make(chan playwright.Download, 1)
+	onDownload := func(download playwright.Download) {
+		select {
+		case downloads <- download:
+		default:
+		}
+	}
+	r.page.On("download", onDownload)
+	defer r.page.RemoveListener("download", onDownload)
+
 	logrus.Printf("Evaluating scraper script")
-	_, err := r.page.EvaluateHandle(scraperScript, struct{}{})
+	result, err := r.page.Evaluate(scraperScript, opts.args(r.Selectors))
 	if err != nil {
-		return nil, fmt.Errorf("could not acquire JSHandle: %w", err)
+		return nil, fmt.Errorf("could not evaluate scraper script: %w", err)
+	}
+	if err := scraperResult(result); err != nil {
+		return nil, err
 	}
 
 	logrus.Printf("Downloading map")
-	download, err := r.page.ExpectDownload(func() error { return nil })
-	if err != nil {
-		return nil, fmt.Errorf("could not download image: %w", err)
+	var download playwright.Download
+	select {
+	case download = <-downloads:
+	case <-time.After(scraperDownloadTimeout):
+		return nil, ErrDownloadTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
 	logrus.Printf("Saving map")
-	outputLocation := path.Join(r.downloadDirectory, "map.png")
+	outputLocation := path.Join(r.downloadDirectory, "map."+opts.Format)
 	err = download.SaveAs(outputLocation)
 	if err != nil {
 		return nil, fmt.Errorf("could not save image: %w", err)
@@ -484,147 +883,151 @@ func (r *Roll20Browser) getMap(isPreload bool) (image.Image, error) {
 	}
 	defer mapFile.Close()
 
-	img, err := png.Decode(mapFile)
+	img, _, err = image.Decode(mapFile)
 	if err != nil {
-		return nil, fmt.Errorf("could not read downloaded file as PNG: %w", err)
+		return nil, fmt.Errorf("could not read downloaded file as %s: %w", opts.Format, err)
 	}
 
 	return img, nil
 }
 
-func (r *Roll20Browser) periodicGetMap(isPreload bool) {
+// periodicGetMap refreshes the cached map every 30 seconds, or just once
+// right away if once is set.
+func (r *Roll20Browser) periodicGetMap(ctx context.Context, once bool) {
 	sleepDuration := time.Second * 30
-	if !isPreload {
-		time.Sleep(sleepDuration)
+	if !once && sleepContext(ctx, sleepDuration) != nil {
+		return
 	}
 
-	for !r.closed {
+	for ctx.Err() == nil {
 		logrus.Printf("Starting periodic map fetch")
-		img, err := r.getMap(isPreload)
-		if err != nil {
+		var img image.Image
+		var page *PageData
+		err := r.do(ctx, JobCaptureMap, PriorityPeriodic, captureMapTimeout, func(ctx context.Context) error {
+			var err error
+			img, err = r.getMap(ctx, r.Scraper)
+			if err != nil {
+				return err
+			}
+			page, err = r.getPageData()
+			if err != nil {
+				// the map itself is still usable without token positions
+				logrus.Errorf("Error getting page data: %s", err)
+			}
+			return nil
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		r.cacheLock.Lock()
+		r.lastMapError = err
+		r.cacheLock.Unlock()
+		if errors.Is(err, ErrCanvasTainted) {
+			// reloading does not help until the offending image is removed
+			logrus.Errorf("Error getting map: %s", err)
+			if once || sleepContext(ctx, sleepDuration) != nil {
+				return
+			}
+			continue
+		} else if err != nil {
 			logrus.Errorf("Error getting map: %s", err)
-			r.Relaunch()
+			r.Relaunch(ctx, RelaunchMapError)
 			continue
 		}
-
+		processingStart := time.Now()
 		logrus.Printf("Getting visible parts of image")
-		img = getVisible(img)
+		img = getVisible(img, r.Visible)
 
-		dim := img.Bounds()
-		if dim.Dx() > int(r.resolution) || dim.Dy() > int(r.resolution) {
-			logrus.Printf("Resizing image")
-			// resize and preserve aspect ratio
-			img = resize.Resize(r.resolution, 0, img, resize.Lanczos3)
+		encoded, err := r.encodeMap(img, 0)
+		observeSince(imageProcessingSeconds, r.game, processingStart)
+		if err != nil {
+			logrus.Errorf("Error encoding map: %s", err)
 		} else {
-			logrus.Printf("Image is smaller than requested resolution, not resizing")
-		}
-
-		logrus.Printf("Converting image to buffer")
-		// write new images to buffer
-		buf := new(bytes.Buffer)
-		jpeg.Encode(buf, img, nil)
-
-		r.cachedImg = buf.Bytes()
-		logrus.Printf("Image saved")
+			capture := &mapCapture{
+				full:    img,
+				encoded: encoded,
+				page:    page,
+				scale:   r.Scraper.scale(),
+				time:    time.Now(),
+			}
+			// the current capture is read under the lock, but compared
+			// outside of it since only this loop replaces the map
+			current := r.getMapCapture()
+			changed := current != nil && mapDifference(current.full, capture.full) > 0
+			r.cacheLock.Lock()
+			if changed {
+				r.previousMap = current
+			}
+			r.cachedMap = capture
+			r.cacheLock.Unlock()
+			r.health.set(func(h *Health) { h.LastMap = capture.time })
+			logrus.Printf("Image saved")
 
-		if isPreload {
-			break
+			r.handleMapCapture(capture)
 		}
 
-		time.Sleep(sleepDuration)
-	}
-}
-
-// getVisible crops the provided image to the bounding box of visible pixels.
-// A pixel is considered "visible" if it is not black, i.e. if its RGB value
-// does not equal (0, 0, 0).
-func getVisible(img image.Image) image.Image {
-	rect := img.Bounds()
-
-	logrus.Printf("Source image dimensions %d, %d, %d, %d", rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y)
-
-	var minX int
-	found := false
-	for minX = rect.Min.X; minX < rect.Max.X; minX++ {
-		for y := rect.Min.Y; y < rect.Max.Y; y++ {
-			c := img.At(minX, y)
-			r, g, b, _ := c.RGBA()
-			if r != 0 || g != 0 || b != 0 {
-				found = true
-				break
-			}
-		}
-		if found {
-			break
+		if once || sleepContext(ctx, sleepDuration) != nil {
+			return
 		}
 	}
+}
 
-	if !found {
-		logrus.Printf("Entire image is blank, returning whole thing")
-		return img
-	}
-
-	var minY int
-	found = false
-	for minY = rect.Min.Y; minY < rect.Max.Y; minY++ {
-		for x := rect.Min.X; x < rect.Max.X; x++ {
-			c := img.At(x, minY)
-			r, g, b, _ := c.RGBA()
-			if r != 0 || g != 0 || b != 0 {
-				found = true
-				break
-			}
-		}
-		if found {
-			break
+// handleMapCapture queues the capture for the map handlers, replacing a
+// capture they have not got to yet. Only the capture loop sends, so there
+// is room once the old capture is taken out.
+func (r *Roll20Browser) handleMapCapture(capture *mapCapture) {
+	select {
+	case r.captures <- capture:
+	default:
+		select {
+		case <-r.captures:
+		default:
 		}
+		r.captures <- capture
 	}
+}
 
-	var maxX int
-	found = false
-	for maxX = rect.Max.X - 1; maxX >= rect.Min.X; maxX-- {
-		for y := rect.Max.Y - 1; y >= rect.Min.Y; y-- {
-			c := img.At(maxX, y)
-			r, g, b, _ := c.RGBA()
-			if r != 0 || g != 0 || b != 0 {
-				found = true
-				break
+// runMapHandlers passes queued captures to the map handlers until ctx is
+// done.
+func (r *Roll20Browser) runMapHandlers(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case capture := <-r.captures:
+			for _, handler := range r.mapHandlers {
+				handler(capture)
 			}
 		}
-		if found {
-			break
-		}
 	}
+}
 
-	var maxY int
-	found = false
-	for maxY = rect.Max.Y - 1; maxY >= rect.Min.Y; maxY-- {
-		for x := rect.Max.X - 1; x >= rect.Min.X; x-- {
-			c := img.At(x, maxY)
-			r, g, b, _ := c.RGBA()
-			if r != 0 || g != 0 || b != 0 {
-				found = true
-				break
-			}
-		}
-		if found {
-			break
-		}
+// uploadLimit returns the largest size an encoded map may have, given the
+// upload limit of the guild it is posted to. A limit of zero means
+// Discord's default upload limit.
+func (r *Roll20Browser) uploadLimit(limit int) int {
+	if limit <= 0 {
+		limit = discordUploadLimit
 	}
-
-	maxX++
-	maxY++
-
-	if minX == rect.Min.X && minY == rect.Min.Y && maxX == rect.Max.X && maxY == rect.Max.Y {
-		logrus.Printf("Entire image is visible, not cropping")
-		return img
+	if r.Output.MaxBytes > 0 && r.Output.MaxBytes < limit {
+		limit = r.Output.MaxBytes
 	}
+	return limit
+}
 
-	logrus.Printf("Cropping to %d, %d, %d, %d", minX, minY, maxX, maxY)
-
-	type subImager interface {
-		SubImage(r image.Rectangle) image.Image
+// encodeMap resizes the provided image to the configured resolution and
+// encodes it for posting to Discord, reducing it further if needed to fit
+// the upload limit.
+func (r *Roll20Browser) encodeMap(img image.Image, limit int) (*encodedImage, error) {
+	dim := img.Bounds()
+	if dim.Dx() > int(r.Resolution) || dim.Dy() > int(r.Resolution) {
+		logrus.Printf("Resizing image")
+		// resize and preserve aspect ratio
+		img = resize.Resize(r.Resolution, 0, img, resize.Lanczos3)
+	} else {
+		logrus.Printf("Image is smaller than requested resolution, not resizing")
 	}
 
-	return img.(subImager).SubImage(image.Rect(minX, minY, maxX, maxY))
+	logrus.Printf("Converting image to buffer")
+	return encodeImage(img, r.Output, r.uploadLimit(limit))
 }
@@ -1,2 +1,14 @@
 #!/bin/bash
-xvfb-run --auto-servernum --server-args='-screen 0 1280x720x24' roll20mapbot $@
\ No newline at end of file
+# a virtual display is only needed for headed browsers, so run without one
+# when Xvfb is not installed, e.g. in images built for headless mode
+if command -v Xvfb > /dev/null; then
+    # start Xvfb here instead of through xvfb-run, which keeps its command
+    # as a child and does not pass on the SIGTERM sent by docker stop
+    Xvfb :99 -screen 0 1280x720x24 -nolisten tcp &
+    export DISPLAY=:99
+    for _ in $(seq 50); do
+        [ -e /tmp/.X11-unix/X99 ] && break
+        sleep 0.1
+    done
+fi
+exec roll20mapbot "$@"
@@ -1,5 +1,8 @@
-function scrape() {
-	eval(
+function scrape(options) {
+	// options is passed from Go, see ScraperOptions in scraper.go. the
+	// returned promise resolves to the result of the capture, see
+	// scraperResult in scraper.go
+	return eval(
 		`
 	// adapted from https://gist.github.com/seleb/690228f38e3ef4e497760d646e6c8d8d
 
@@ -33,12 +36,16 @@ function scrape() {
 	- if you have any issues using this script, feel free to reach out!
 	*/
 
+	// DOM selectors from the selector profile, see selectors.go
+	const selectors = options.selectors;
+
 	// main
 	async function saveMap() {
-		const frameRetries = 10;
-		const zoom = 100; // must be a multiple of 10 between 10 and 250
-		const curZoom = Number(document.querySelector('#zoomPercent')?.textContent || '100') || 100;
-		const editorWrapper = document.querySelector('#editor-wrapper');
+		const frameRetries = options.frameRetries;
+		const zoom = options.zoom; // must be a multiple of 10 between 10 and 250
+		const curZoom = Number(document.querySelector(selectors.zoom_percent)?.textContent || '100') || 100;
+		const editorWrapper = document.querySelector(selectors.editor_wrapper);
+		const editor = document.querySelector(selectors.editor);
 		try {
 			console.log('saving map...');
 			// get total size
@@ -54,8 +61,11 @@ function scrape() {
 			outputCanvas.height = height;
 			const ctx = outputCanvas.getContext('2d', { willReadFrequently: true });
 
-			const finalCanvas = document.querySelector('#babylonCanvas');
-			if (!finalCanvas) throw new Error("Could not find game canvas");
+			const finalCanvas = document.querySelector(selectors.map_canvas);
+			if (!finalCanvas) throw new ScrapeError('canvas_missing', "Could not find game canvas");
+
+			// hide layers that should not be captured
+			setLayersHidden(options.hiddenLayers, true);
 
 			// set zoom to output size
 			setZoom(zoom);
@@ -64,8 +74,7 @@ function scrape() {
 			await raf();
 
 			// add some extra padding so we can scroll through fully
-			const editor = document.querySelector('#editor');
-			if (!finalCanvas) throw new Error("Could not find editor");
+			if (!editor || !editorWrapper) throw new ScrapeError('canvas_missing', "Could not find editor");
 			editor.style.paddingRight = ` + '`' + `\${finalCanvas.width/scale}px` + '`' + `;
 			editor.style.paddingBottom = ` + '`' + `\${finalCanvas.height/scale}px` + '`' + `;
 
@@ -111,36 +120,76 @@ function scrape() {
 						if (retry && tries > 0) {
 							return renderFrame(tries-1);
 						} else if (retry) {
-							throw new Error(` + '`' + `Could not render frame after \${frameRetries} tries; please try again with "frameRetries" set to a higher number or let me know if this keeps happening!` + '`' + `);
+							throw new ScrapeError('render_timeout', ` + '`' + `Could not render frame after \${frameRetries} tries` + '`' + `);
 						}
 					};
 					await renderFrame(frameRetries);
 
-					console.log(` + '`' + `\${Math.floor(++progress / count * 100)}%` + '`' + `);
+					reportProgress(Math.floor(++progress / count * 100));
 				}
 			}
 
-			drawNameplates(ctx);
+			if (options.nameplates) {
+				drawNameplates(ctx);
+			}
 
 			// open output
-			var url = outputCanvas.toDataURL();
+			var url = outputCanvas.toDataURL('image/' + options.format, options.quality / 100);
 			var a = $("<a>")
 				.attr("href", url)
-				.attr("download", "map.png")
+				.attr("download", 'map.' + options.format)
 				.appendTo("body");
 			a[0].click();
 			a.remove();
 			console.log('map saved!');
 		} finally {
 			// remove extra padding
-			editor.style.paddingRight = null;
-			editor.style.paddingBottom = null;
+			if (editor) {
+				editor.style.paddingRight = null;
+				editor.style.paddingBottom = null;
+			}
 
 			// reset zoom
 			setZoom(curZoom);
+
+			// show hidden layers again
+			setLayersHidden(options.hiddenLayers, false);
+			window.Campaign.view.render();
 		}
 	}
 
+	// helper
+	// an error with a code that tells the bot what went wrong
+	class ScrapeError extends Error {
+		constructor(code, message) {
+			super(message);
+			this.code = code;
+		}
+	}
+
+	// helper
+	// reports capture progress in percent to the bot, if it is listening
+	function reportProgress(percent) {
+		console.log(percent + '%');
+		if (window.roll20mapbotProgress) {
+			window.roll20mapbotProgress(percent);
+		}
+	}
+
+	// helper
+	// hides or shows the graphics on the given layers for this client only,
+	// without saving anything to the game
+	function setLayersHidden(layers, hidden) {
+		if (!layers || layers.length === 0) return;
+		window.Campaign.activePage().thegraphics.each(graphic => {
+			if (!layers.includes(graphic.get('layer'))) return;
+			const view = graphic.view;
+			if (view && view.graphic) {
+				view.graphic.visible = !hidden;
+			}
+		});
+	}
+
 	// helper
 	// returns promise resolving on next animation frame
 	function raf() {
@@ -150,9 +199,9 @@ function scrape() {
 	// helper
 	function setZoom(zoom) {
 		try {
-			Array.from(document.querySelector('.selZoom').children).find(({
+			Array.from(document.querySelector(selectors.zoom_select).children).find(({
 				value
-			}) => value === zoom).click();
+			}) => value === String(zoom)).click();
 		} catch (err) {
 			if (zoom !== 100) {
 				setZoom(100);
@@ -161,15 +210,12 @@ function scrape() {
 	}
 
 	function drawNameplates(ctx) {
-		const propLayer = '#token-properties-layer';
-		const propLayerElem = $(propLayer)[0];
-		const nameplates = $('.nameplate');
-		const numProps = propLayerElem.children.length;
+		const propLayerElem = $(selectors.token_properties_layer)[0];
+		const nameplates = $(selectors.nameplates);
+		const props = propLayerElem.querySelectorAll(':scope > div');
 		let largest = null;
-		for (let i = 1; i <= numProps; ++i) {
-			const child = propLayer + ' > div:nth-child(' + i + ')';
-			const childElem = $(child)[0];
-			const childRect = $(child)[0].getBoundingClientRect();
+		for (const prop of props) {
+			const childRect = prop.getBoundingClientRect();
 			if (largest == null) {
 				largest = childRect;
 			} else if (largest.height < childRect.height && largest.width < childRect.width) {
@@ -195,11 +241,17 @@ function scrape() {
 		});
 	}
 
-	// actually run it
-	saveMap().catch(err => {
-		console.error(` + '`' + `something went wrong while saving map
-	if the error mentions an "insecure operation", your map may be tainted (see notes at top of script for more info)
-	` + '`' + `, err);
+	// actually run it, resolving to the result instead of rejecting so the
+	// error code makes it back to the bot
+	saveMap().then(() => ({ error: null }), err => {
+		console.error('something went wrong while saving map', err);
+		let code = err.code || 'unknown';
+		// toDataURL and getImageData throw a SecurityError once an image
+		// from another origin has been drawn on the canvas
+		if (err.name === 'SecurityError') {
+			code = 'canvas_tainted';
+		}
+		return { error: { code: code, message: String(err.message || err) } };
 	});
 	`);
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	// registers the webp decoder for captures exported as webp
+	_ "golang.org/x/image/webp"
+)
+
+// Errors reported by scrape.js. Captures that fail with one of these are
+// wrapped with the message from the script.
+var (
+	// ErrCanvasTainted means an image from another origin was drawn on the
+	// map, so the browser refuses to export it. It persists until the image
+	// is removed from the page.
+	ErrCanvasTainted = errors.New("map canvas is tainted by an image from another site")
+	// ErrCanvasMissing means the roll20 editor or its canvas was not found.
+	ErrCanvasMissing = errors.New("could not find the map canvas")
+	// ErrRenderTimeout means part of the map was still blank after all
+	// frame retries.
+	ErrRenderTimeout = errors.New("map did not finish rendering")
+	// ErrDownloadTimeout means the capture succeeded but the browser never
+	// started downloading it.
+	ErrDownloadTimeout = errors.New("map download did not start")
+	ErrScraperFailed   = errors.New("scraper script failed")
+)
+
+var scraperErrors = map[string]error{
+	"canvas_tainted": ErrCanvasTainted,
+	"canvas_missing": ErrCanvasMissing,
+	"render_timeout": ErrRenderTimeout,
+}
+
+// scraperDownloadTimeout is how long to wait for the download of a
+// finished capture to start.
+const scraperDownloadTimeout = 30 * time.Second
+
+// scraperProgressBinding is the name of the function scrape.js calls to
+// report its progress.
+const scraperProgressBinding = "roll20mapbotProgress"
+
+// scraperResult converts the value the scrape.js promise resolves to into
+// an error, or nil if the capture succeeded.
+func scraperResult(result interface{}) error {
+	values, ok := result.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: unexpected result %v", ErrScraperFailed, result)
+	}
+	failure, ok := values["error"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	code, _ := failure["code"].(string)
+	message, _ := failure["message"].(string)
+	err, ok := scraperErrors[code]
+	if !ok {
+		err = ErrScraperFailed
+	}
+	return fmt.Errorf("%w: %s", err, message)
+}
+
+// ScraperOptions are passed to scrape.js to control how the map is captured.
+type ScraperOptions struct {
+	// Zoom is the zoom level the map is captured at, in percent. Roll20 only
+	// supports multiples of 10 between 10 and 250.
+	Zoom int `json:"zoom" default:"100"`
+	// FrameRetries is how many times a chunk of the map is re-rendered
+	// before giving up.
+	FrameRetries int  `json:"frame_retries" default:"10"`
+	Nameplates   bool `json:"nameplates" default:"true"`
+	// HiddenLayers are roll20 layers, such as "objects" for tokens, that
+	// are left out of the capture.
+	HiddenLayers []string `json:"hidden_layers"`
+	// Format is the image format the canvas is exported as: png, jpeg or
+	// webp.
+	Format string `json:"format" default:"png"`
+	// Quality is the export quality for jpeg and webp, from 1 to 100.
+	Quality int `json:"quality" default:"92"`
+}
+
+var scraperFormats = map[string]bool{
+	"png":  true,
+	"jpeg": true,
+	"webp": true,
+}
+
+// Validate checks that the options are supported by scrape.js.
+func (o ScraperOptions) Validate() error {
+	if o.Zoom < 10 || o.Zoom > 250 || o.Zoom%10 != 0 {
+		return fmt.Errorf("zoom must be a multiple of 10 between 10 and 250")
+	}
+	if o.FrameRetries < 0 {
+		return fmt.Errorf("frame retries must not be negative")
+	}
+	if !scraperFormats[o.Format] {
+		return fmt.Errorf("unknown scraper format %q", o.Format)
+	}
+	if o.Quality < 1 || o.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100")
+	}
+	return nil
+}
+
+// WithHiddenLayer returns a copy of the options that also hides layer.
+func (o ScraperOptions) WithHiddenLayer(layer string) ScraperOptions {
+	o.HiddenLayers = append(append([]string(nil), o.HiddenLayers...), layer)
+	return o
+}
+
+// scale returns the ratio between captured pixels and page pixels.
+func (o ScraperOptions) scale() float64 {
+	return float64(o.Zoom) / 100
+}
+
+// args converts the options and the DOM selectors of the profile to the
+// argument of scrape.js. Playwright only serializes maps, slices of
+// interface{} and basic values, not structs.
+func (o ScraperOptions) args(profile *SelectorProfile) map[string]interface{} {
+	layers := []interface{}{}
+	for _, layer := range o.HiddenLayers {
+		layers = append(layers, layer)
+	}
+	return map[string]interface{}{
+		"zoom":         o.Zoom,
+		"frameRetries": o.FrameRetries,
+		"nameplates":   o.Nameplates,
+		"hiddenLayers": layers,
+		"format":       o.Format,
+		"quality":      o.Quality,
+		"selectors":    profile.selectors(),
+	}
+}
+
+// CaptureMap takes a new capture of the map with the given options instead
+// of returning the cached one. The capture is not cached.
+func (r *Roll20Browser) CaptureMap(ctx context.Context, opts ScraperOptions, limit int) (*encodedImage, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	var img image.Image
+	err = r.do(ctx, JobRefreshMap, PriorityUser, captureMapTimeout, func(ctx context.Context) (err error) {
+		img, err = r.getMap(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Printf("Captured map on request in %s", time.Since(start))
+
+	return r.encodeMap(getVisible(img, r.Visible), limit)
+}
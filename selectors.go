@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//go:embed selectors.json
+var defaultSelectorProfile []byte
+
+// SelectorProfile holds the DOM selectors and page text used to drive the
+// roll20 UI, so that they can be updated without a rebuild when roll20
+// changes.
+type SelectorProfile struct {
+	// Version identifies the roll20 UI the profile was written for.
+	Version string `json:"version" profile:"text"`
+
+	SignInDropdown  string `json:"sign_in_dropdown"`
+	LoginEmail      string `json:"login_email"`
+	LoginPassword   string `json:"login_password"`
+	LoginButtons    string `json:"login_buttons"`
+	LoginButtonText string `json:"login_button_text" profile:"text"`
+
+	GameLinks string `json:"game_links"`
+
+	// JournalAnchors are searched for the one whose href ends with
+	// JournalAnchorSuffix, which opens the journal tab.
+	JournalAnchors      string   `json:"journal_anchors"`
+	JournalAnchorSuffix string   `json:"journal_anchor_suffix" profile:"text"`
+	JournalNames        string   `json:"journal_names"`
+	JournalItems        string   `json:"journal_items"`
+	IgnoredJournalNames []string `json:"ignored_journal_names"`
+
+	PrintSheetButton  string `json:"print_sheet_button"`
+	CloseDialogButton string `json:"close_dialog_button"`
+
+	// The scraper finds the map and its controls with these. They are
+	// passed to scrape.js under their JSON names.
+	ZoomPercent          string `json:"zoom_percent"`
+	ZoomSelect           string `json:"zoom_select"`
+	EditorWrapper        string `json:"editor_wrapper"`
+	Editor               string `json:"editor"`
+	MapCanvas            string `json:"map_canvas"`
+	TokenPropertiesLayer string `json:"token_properties_layer"`
+	Nameplates           string `json:"nameplates"`
+}
+
+// checkSelectorsScript returns the selectors the browser cannot parse, with
+// the error of each.
+const checkSelectorsScript = `selectors => {
+	const invalid = {};
+	const fragment = document.createDocumentFragment();
+	for (const [name, selector] of Object.entries(selectors)) {
+		try {
+			fragment.querySelector(selector);
+		} catch (err) {
+			invalid[name] = String(err.message || err);
+		}
+	}
+	return invalid;
+}`
+
+// LoadSelectorProfile returns the embedded selector profile with any
+// settings from the file at path applied over it. An empty path uses the
+// embedded profile as is.
+func LoadSelectorProfile(path string) (*SelectorProfile, error) {
+	profile := &SelectorProfile{}
+	err := decodeSelectorProfile(defaultSelectorProfile, profile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read embedded selector profile: %w", err)
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read selector profile: %w", err)
+		}
+		err = decodeSelectorProfile(data, profile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read selector profile %s: %w", path, err)
+		}
+	}
+
+	return profile, profile.Validate()
+}
+
+// decodeSelectorProfile rejects unknown keys, which are most likely typos
+// that would otherwise silently leave the default in place.
+func decodeSelectorProfile(data []byte, profile *SelectorProfile) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(profile)
+}
+
+// Validate checks that no selector or text of the profile is empty.
+func (p *SelectorProfile) Validate() error {
+	v := reflect.ValueOf(p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.String && field.String() == "" {
+			return fmt.Errorf("selector profile is missing %s", v.Type().Field(i).Tag.Get("json"))
+		}
+	}
+	return nil
+}
+
+// selectors returns the DOM selectors of the profile by their JSON names,
+// leaving out page text, in the form Playwright passes to scripts.
+func (p *SelectorProfile) selectors() map[string]interface{} {
+	selectors := make(map[string]interface{})
+	v := reflect.ValueOf(p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.Kind() != reflect.String || field.Tag.Get("profile") == "text" {
+			continue
+		}
+		selectors[field.Tag.Get("json")] = v.Field(i).String()
+	}
+	return selectors
+}
+
+// checkSelectors has the browser parse every selector of the profile, so
+// that a malformed one fails the launch instead of the operations using it.
+func (r *Roll20Browser) checkSelectors() error {
+	result, err := r.page.Evaluate(checkSelectorsScript, r.Selectors.selectors())
+	if err != nil {
+		return fmt.Errorf("could not check selectors: %w", err)
+	}
+	invalid, _ := result.(map[string]interface{})
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	var problems []string
+	for name, message := range invalid {
+		problems = append(problems, fmt.Sprintf("%s: %v", name, message))
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("invalid selectors in profile: %s", strings.Join(problems, "; "))
+}
+
+func (p *SelectorProfile) ignoredJournalName(name string) bool {
+	for _, ignored := range p.IgnoredJournalNames {
+		if name == ignored {
+			return true
+		}
+	}
+	return false
+}
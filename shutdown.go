@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/sirupsen/logrus"
+)
+
+// restartingMessage answers commands received while the bot shuts down.
+const restartingMessage = "Bot restarting, please try again in a minute"
+
+// startHandler registers a command handler about to run, so that Close
+// waits for it. It returns false once the bot is shutting down, in which
+// case the command must not run.
+func (app *Application) startHandler() bool {
+	app.handlerLock.Lock()
+	defer app.handlerLock.Unlock()
+	if app.shuttingDown {
+		return false
+	}
+	app.handlers.Add(1)
+	atomic.AddInt64(&app.inFlight, 1)
+	return true
+}
+
+func (app *Application) finishHandler() {
+	atomic.AddInt64(&app.inFlight, -1)
+	app.handlers.Done()
+}
+
+// InFlight returns the number of command handlers running.
+func (app *Application) InFlight() int {
+	return int(atomic.LoadInt64(&app.inFlight))
+}
+
+// drainHandlers stops new command handlers from starting and waits up to
+// timeout for the running ones to finish. It returns false if some were
+// still running.
+func (app *Application) drainHandlers(timeout time.Duration) bool {
+	app.handlerLock.Lock()
+	app.shuttingDown = true
+	app.handlerLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		app.handlers.Wait()
+		close(done)
+	}()
+
+	logrus.Printf("Waiting for %d running commands to finish", app.InFlight())
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		logrus.Warnf("%d commands still running after %s, shutting down anyway", app.InFlight(), timeout)
+		return false
+	}
+}
+
+func replyRestarting(s *discordgo.Session, m *discordgo.MessageCreate) {
+	_, err := s.ChannelMessageSendReply(m.ChannelID, restartingMessage, m.Reference())
+	if err != nil {
+		logrus.Errorf("Error responding: %s", err)
+	}
+}
+
+func respondRestarting(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: restartingMessage,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		logrus.Errorf("Error responding: %s", err)
+	}
+}
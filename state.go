@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// State holds bot settings changed through Discord commands, which are
+// persisted so that they survive restarts.
+type State struct {
+	path string
+	lock sync.Mutex
+	data stateData
+}
+
+type stateData struct {
+	// LiveChannels are the channels with live mode turned on.
+	LiveChannels []string `json:"live_channels"`
+	// LiveMaps maps channels to the ID of their pinned live map message.
+	LiveMaps map[string]string `json:"live_maps"`
+}
+
+// LoadState reads the state file at path. A missing file results in an
+// empty state. If path is empty, the state is kept in memory only.
+func LoadState(path string) (*State, error) {
+	s := &State{
+		path: path,
+		data: stateData{
+			LiveMaps: make(map[string]string),
+		},
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open state file: %w", err)
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&s.data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode state file: %w", err)
+	}
+	if s.data.LiveMaps == nil {
+		s.data.LiveMaps = make(map[string]string)
+	}
+	return s, nil
+}
+
+// save writes the state to disk. The lock must be held by the caller.
+func (s *State) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode state: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.path), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create state directory: %w", err)
+	}
+
+	// write to a temporary file first so a crash cannot leave a partial state
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(raw)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write state file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("could not replace state file: %w", err)
+	}
+	return nil
+}
+
+func (s *State) LiveChannels() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.data.LiveChannels...)
+}
+
+func (s *State) SetLiveChannel(channelID string, enabled bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	channels := make(map[string]bool)
+	for _, c := range s.data.LiveChannels {
+		channels[c] = true
+	}
+	if enabled {
+		channels[channelID] = true
+	} else {
+		delete(channels, channelID)
+	}
+
+	s.data.LiveChannels = nil
+	for c := range channels {
+		s.data.LiveChannels = append(s.data.LiveChannels, c)
+	}
+	sort.Strings(s.data.LiveChannels)
+	return s.save()
+}
+
+// LiveMaps returns the pinned live map message ID of every channel.
+func (s *State) LiveMaps() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make(map[string]string)
+	for channelID, messageID := range s.data.LiveMaps {
+		result[channelID] = messageID
+	}
+	return result
+}
+
+// SetLiveMap records the pinned live map message of a channel. An empty
+// messageID removes the channel's live map.
+func (s *State) SetLiveMap(channelID, messageID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if messageID == "" {
+		delete(s.data.LiveMaps, channelID)
+	} else {
+		s.data.LiveMaps[channelID] = messageID
+	}
+	return s.save()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// maxAttachments is the most files Discord allows on a single message.
+const maxAttachments = 10
+
+// overviewWidth is the width of the overview sent before map tiles.
+const overviewWidth = 800
+
+// mapTile is one piece of a map split up by GetMapTiles.
+type mapTile struct {
+	Label string
+	Image *encodedImage
+}
+
+// GetMapTiles splits the cached full resolution map into tiles no larger
+// than tileSize pixels. When the page grid is known, tiles are aligned to
+// it and labeled with the range of cells they cover. It also returns an
+// overview of the whole map with the tiles outlined. Each image is encoded
+// to fit in its share of the upload limit of a message.
+func (r *Roll20Browser) GetMapTiles(tileSize uint, limit int) (*encodedImage, []mapTile, error) {
+	capture := r.getMapCapture()
+	if capture == nil {
+		return nil, nil, r.mapNotReady()
+	}
+
+	full := toNRGBA(capture.full)
+	bounds := full.Bounds()
+
+	size := int(tileSize)
+	origin := bounds.Min
+	var grid float64
+	if capture.page != nil {
+		grid = capture.page.GridSize() * capture.scale
+		// round tiles down to whole cells and start them on a cell boundary
+		if cells := size / int(grid); cells > 0 {
+			size = cells * int(grid)
+		}
+		origin = image.Pt(
+			int(float64(int(float64(bounds.Min.X)/grid))*grid),
+			int(float64(int(float64(bounds.Min.Y)/grid))*grid),
+		)
+	}
+
+	var rects []image.Rectangle
+	for y := origin.Y; y < bounds.Max.Y; y += size {
+		for x := origin.X; x < bounds.Max.X; x += size {
+			rect := image.Rect(x, y, x+size, y+size).Intersect(bounds)
+			if !rect.Empty() {
+				rects = append(rects, rect)
+			}
+		}
+	}
+
+	tileLimit := r.uploadLimit(limit) / maxAttachments
+	var tiles []mapTile
+	for _, rect := range rects {
+		label := fmt.Sprintf("%d,%d to %d,%d", rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y)
+		if capture.page != nil {
+			first := GridCell{Column: int(float64(rect.Min.X) / grid), Row: int(float64(rect.Min.Y) / grid)}
+			last := GridCell{Column: int(float64(rect.Max.X-1) / grid), Row: int(float64(rect.Max.Y-1) / grid)}
+			label = fmt.Sprintf("%s-%s", first, last)
+		}
+
+		tile := image.NewNRGBA(rect.Sub(rect.Min))
+		draw.Draw(tile, tile.Rect, full, rect.Min, draw.Src)
+		drawLabel(tile, image.Pt(4, 4), label)
+
+		encoded, err := r.encodeMap(tile, tileLimit)
+		if err != nil {
+			return nil, nil, err
+		}
+		tiles = append(tiles, mapTile{Label: label, Image: encoded})
+	}
+
+	width := uint(overviewWidth)
+	if bounds.Dx() < overviewWidth {
+		width = uint(bounds.Dx())
+	}
+	overview := toNRGBA(resize.Resize(width, 0, full, resize.Lanczos3))
+	scale := float64(overview.Bounds().Dx()) / float64(bounds.Dx())
+	for i, rect := range rects {
+		scaled := image.Rect(
+			int(float64(rect.Min.X-bounds.Min.X)*scale),
+			int(float64(rect.Min.Y-bounds.Min.Y)*scale),
+			int(float64(rect.Max.X-bounds.Min.X)*scale),
+			int(float64(rect.Max.Y-bounds.Min.Y)*scale),
+		)
+		drawOutline(overview, scaled, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+		drawLabel(overview, scaled.Min.Add(image.Pt(3, 3)), tiles[i].Label)
+	}
+
+	encoded, err := r.encodeMap(overview, tileLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encoded, tiles, nil
+}
+
+// drawLabel writes text on a dark box with its top left corner at pt.
+func drawLabel(img draw.Image, pt image.Point, text string) {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	box := image.Rect(pt.X, pt.Y, pt.X+width+6, pt.Y+face.Height+4)
+	draw.Draw(img, box, image.NewUniform(color.NRGBA{A: 160}), image.Point{}, draw.Over)
+
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(pt.X+3, pt.Y+2+face.Ascent),
+	}
+	d.DrawString(text)
+}
+
+// drawOutline draws a one pixel border just inside rect.
+func drawOutline(img draw.Image, rect image.Rectangle, c color.Color) {
+	src := image.NewUniform(c)
+	draw.Draw(img, image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+1), src, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(rect.Min.X, rect.Max.Y-1, rect.Max.X, rect.Max.Y), src, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+1, rect.Max.Y), src, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(rect.Max.X-1, rect.Min.Y, rect.Max.X, rect.Max.Y), src, image.Point{}, draw.Src)
+}
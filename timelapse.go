@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"os"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// timelapseWidth is the width of timelapse frames before any reductions
+	// needed to fit the upload limit.
+	timelapseWidth = 640
+	// timelapseMinWidth is the smallest width a timelapse is reduced to.
+	timelapseMinWidth = 160
+	// timelapseMaxFrames caps the frames kept in memory while rendering.
+	timelapseMaxFrames = 200
+	// timelapseMinFrames is the fewest frames the frame rate is reduced to
+	// before the frames are made smaller instead.
+	timelapseMinFrames = 20
+	// timelapseFrameDelay is the display time of each frame in 100ths of a
+	// second.
+	timelapseFrameDelay = 50
+)
+
+type TimelapseOptions struct {
+	From time.Time
+	To   time.Time
+	// Page selects the page to animate. When empty, the page of the latest
+	// snapshot in the time range is used.
+	Page string
+	// MaxBytes is the largest allowed size of the encoded animation.
+	MaxBytes int
+}
+
+// Bounds returns the area of the page covered by the snapshot, read from
+// the JPEG header without decoding the whole image.
+func (s Snapshot) Bounds() (image.Rectangle, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return image.Rectangle{}, fmt.Errorf("could not open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		return image.Rectangle{}, fmt.Errorf("could not read snapshot: %w", err)
+	}
+	return image.Rect(0, 0, cfg.Width, cfg.Height).Add(s.Min), nil
+}
+
+// BuildTimelapse renders the archived snapshots between two times as an
+// animated GIF. It returns the encoded animation and its number of frames.
+//
+// Every frame is drawn into the union of all snapshot bounds, so the map
+// stays in place even though getVisible crops each capture differently.
+// Consecutive identical frames are merged. If the animation does not fit
+// in MaxBytes, frames are dropped and then shrunk until it does.
+func BuildTimelapse(archive *MapArchive, opts TimelapseOptions) ([]byte, int, error) {
+	all, err := archive.List()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// List returns the newest snapshots first
+	var snapshots []Snapshot
+	for i := len(all) - 1; i >= 0; i-- {
+		s := all[i]
+		if s.Time.Before(opts.From) || s.Time.After(opts.To) {
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	if len(snapshots) == 0 {
+		return nil, 0, fmt.Errorf("no maps archived between %s and %s", opts.From.Format(time.RFC1123), opts.To.Format(time.RFC1123))
+	}
+
+	page := opts.Page
+	if page == "" {
+		page = snapshots[len(snapshots)-1].Page
+	}
+	var pageSnapshots []Snapshot
+	for _, s := range snapshots {
+		if s.Page == safePathName(page) {
+			pageSnapshots = append(pageSnapshots, s)
+		}
+	}
+	snapshots = pageSnapshots
+	if len(snapshots) == 0 {
+		return nil, 0, fmt.Errorf("no maps archived for page %q in that time", page)
+	}
+
+	// sample evenly when there are more snapshots than can be held in memory
+	if len(snapshots) > timelapseMaxFrames {
+		sampled := make([]Snapshot, timelapseMaxFrames)
+		for i := range sampled {
+			sampled[i] = snapshots[i*len(snapshots)/timelapseMaxFrames]
+		}
+		snapshots = sampled
+	}
+
+	var union image.Rectangle
+	for _, s := range snapshots {
+		bounds, err := s.Bounds()
+		if err != nil {
+			return nil, 0, err
+		}
+		union = union.Union(bounds)
+	}
+
+	logrus.Printf("Rendering timelapse of %d snapshots", len(snapshots))
+	anim := &gif.GIF{}
+	var previous image.Image
+	for _, s := range snapshots {
+		img, err := s.Load()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		canvas := image.NewNRGBA(union)
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Src)
+
+		if previous != nil && mapDifference(previous, canvas) == 0 {
+			anim.Delay[len(anim.Delay)-1] += timelapseFrameDelay
+			continue
+		}
+		previous = canvas
+
+		anim.Image = append(anim.Image, toPaletted(canvas, timelapseWidth))
+		anim.Delay = append(anim.Delay, timelapseFrameDelay)
+	}
+
+	maxBytes := opts.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = discordUploadLimit
+	}
+
+	for {
+		buf := new(bytes.Buffer)
+		err = gif.EncodeAll(buf, anim)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not encode timelapse: %w", err)
+		}
+		if buf.Len() <= maxBytes {
+			return buf.Bytes(), len(anim.Image), nil
+		}
+
+		width := anim.Image[0].Bounds().Dx()
+		switch {
+		case len(anim.Image) >= 2*timelapseMinFrames:
+			logrus.Printf("Timelapse is %d bytes, reducing frame rate", buf.Len())
+			anim = dropAlternateFrames(anim)
+		case width*3/4 >= timelapseMinWidth:
+			logrus.Printf("Timelapse is %d bytes, reducing size", buf.Len())
+			for i, frame := range anim.Image {
+				anim.Image[i] = toPaletted(frame, uint(width*3/4))
+			}
+			anim.Config = image.Config{}
+		default:
+			return nil, 0, fmt.Errorf("timelapse is too large to upload, try a shorter time range")
+		}
+	}
+}
+
+// dropAlternateFrames halves the frame rate of an animation, keeping its
+// total duration.
+func dropAlternateFrames(anim *gif.GIF) *gif.GIF {
+	result := &gif.GIF{}
+	for i := 0; i < len(anim.Image); i += 2 {
+		delay := anim.Delay[i]
+		if i+1 < len(anim.Delay) {
+			delay += anim.Delay[i+1]
+		}
+		result.Image = append(result.Image, anim.Image[i])
+		result.Delay = append(result.Delay, delay)
+	}
+	return result
+}
+
+// toPaletted scales an image to the given width, if it is wider, and
+// converts it to a GIF frame.
+func toPaletted(img image.Image, width uint) *image.Paletted {
+	if img.Bounds().Dx() > int(width) {
+		img = resize.Resize(width, 0, img, resize.Bilinear)
+	}
+	rect := img.Bounds().Sub(img.Bounds().Min)
+	frame := image.NewPaletted(rect, palette.Plan9)
+	draw.Draw(frame, rect, img, img.Bounds().Min, draw.Src)
+	return frame
+}
@@ -0,0 +1,50 @@
+function tokens() {
+	// reads the active page and the tokens placed on it from the roll20 Campaign model
+	const page = window.Campaign.activePage();
+	if (!page) throw new Error("Could not find active page");
+
+	const result = {
+		page: {
+			name: page.get('name') || '',
+			width: Number(page.get('width')) || 0,
+			height: Number(page.get('height')) || 0,
+			snapping_increment: Number(page.get('snapping_increment')) || 0,
+			grid_type: page.get('grid_type') || 'square',
+			scale_number: Number(page.get('scale_number')) || 5,
+			scale_units: page.get('scale_units') || 'ft',
+			diagonal_type: page.get('diagonaltype') || 'foure',
+		},
+		tokens: [],
+	};
+
+	page.thegraphics.each(graphic => {
+		// only tokens on the objects layer are visible to players
+		if (graphic.get('layer') !== 'objects') return;
+
+		// bars hidden from players are left empty so their values are not leaked
+		const bars = [1, 2, 3].map(i => {
+			if (!graphic.get('showplayers_bar' + i)) return { value: '', max: '' };
+			return {
+				value: String(graphic.get('bar' + i + '_value') ?? ''),
+				max: String(graphic.get('bar' + i + '_max') ?? ''),
+			};
+		});
+
+		// names hidden from players are left empty too, so tokens cannot be
+		// listed or found by them
+		const name = graphic.get('showplayers_name') ? graphic.get('name') || '' : '';
+
+		result.tokens.push({
+			id: graphic.id,
+			name: name,
+			left: Number(graphic.get('left')) || 0,
+			top: Number(graphic.get('top')) || 0,
+			width: Number(graphic.get('width')) || 0,
+			height: Number(graphic.get('height')) || 0,
+			bars: bars,
+			status_markers: (graphic.get('statusmarkers') || '').split(',').filter(m => m !== ''),
+		});
+	});
+
+	return result;
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// VisibleOptions controls how getVisible decides which pixels are empty.
+type VisibleOptions struct {
+	// Background is the color of empty areas of the map.
+	Background color.NRGBA
+	// Tolerance is how far each channel may be from Background, out of 255,
+	// for a pixel to still count as empty.
+	Tolerance uint8
+	// AlphaThreshold is the alpha, out of 255, at or below which pixels are
+	// empty whatever their color.
+	AlphaThreshold uint8
+	// Padding is the number of pixels kept around the visible area.
+	Padding int
+}
+
+// parseHexColor parses a color in the format "#rrggbb".
+func parseHexColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb", s)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q: %w", s, err)
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+}
+
+// getVisible crops the provided image to the bounding box of visible pixels.
+// A pixel is considered "visible" if it is not empty, i.e. if it is opaque
+// enough and its color is not within the tolerance of the background.
+//
+// The scan works directly on the pixel buffer, stopping each row as soon as
+// the bounds found so far cannot grow, so other image types are converted
+// to *image.NRGBA first.
+func getVisible(img image.Image, opts VisibleOptions) image.Image {
+	rect := img.Bounds()
+
+	logrus.Printf("Source image dimensions %d, %d, %d, %d", rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y)
+
+	var pix []uint8
+	var stride int
+	var premultiplied bool
+	switch i := img.(type) {
+	case *image.NRGBA:
+		pix, stride = i.Pix, i.Stride
+	case *image.RGBA:
+		pix, stride, premultiplied = i.Pix, i.Stride, true
+	default:
+		n := toNRGBA(img)
+		pix, stride = n.Pix, n.Stride
+	}
+
+	bg := opts.Background
+	tol := int(opts.Tolerance)
+	within := func(a, b uint8) bool {
+		d := int(a) - int(b)
+		return d <= tol && d >= -tol
+	}
+	// offsets are relative to the start of the buffer, which is rect.Min
+	empty := func(x, y int) bool {
+		p := pix[(y-rect.Min.Y)*stride+(x-rect.Min.X)*4:]
+		r, g, b, a := p[0], p[1], p[2], p[3]
+		if a <= opts.AlphaThreshold {
+			return true
+		}
+		if premultiplied && a != 255 {
+			r = uint8(int(r) * 255 / int(a))
+			g = uint8(int(g) * 255 / int(a))
+			b = uint8(int(b) * 255 / int(a))
+		}
+		return within(r, bg.R) && within(g, bg.G) && within(b, bg.B)
+	}
+	rowEmpty := func(y int) bool {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if !empty(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	minY := rect.Min.Y
+	for minY < rect.Max.Y && rowEmpty(minY) {
+		minY++
+	}
+
+	if minY == rect.Max.Y {
+		logrus.Printf("Entire image is blank, returning whole thing")
+		return img
+	}
+
+	maxY := rect.Max.Y
+	for rowEmpty(maxY - 1) {
+		maxY--
+	}
+
+	// each row only needs scanning up to the horizontal bounds found so far
+	minX, maxX := rect.Max.X, rect.Min.X
+	for y := minY; y < maxY; y++ {
+		for x := rect.Min.X; x < minX; x++ {
+			if !empty(x, y) {
+				minX = x
+				break
+			}
+		}
+		for x := rect.Max.X - 1; x >= maxX; x-- {
+			if !empty(x, y) {
+				maxX = x + 1
+				break
+			}
+		}
+	}
+
+	crop := image.Rect(minX, minY, maxX, maxY).Inset(-opts.Padding).Intersect(rect)
+
+	if crop == rect {
+		logrus.Printf("Entire image is visible, not cropping")
+		return img
+	}
+
+	logrus.Printf("Cropping to %d, %d, %d, %d", crop.Min.X, crop.Min.Y, crop.Max.X, crop.Max.Y)
+
+	type subImager interface {
+		SubImage(r image.Rectangle) image.Image
+	}
+
+	if sub, ok := img.(subImager); ok {
+		return sub.SubImage(crop)
+	}
+	return toNRGBA(img).SubImage(crop)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// getVisibleAt is the scan getVisible replaced, which reads every pixel
+// through At and RGBA. It is kept to benchmark against.
+func getVisibleAt(img image.Image) image.Rectangle {
+	rect := img.Bounds()
+	nonBlack := func(x, y int) bool {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r != 0 || g != 0 || b != 0
+	}
+
+	minX, found := rect.Min.X, false
+	for ; minX < rect.Max.X && !found; minX++ {
+		for y := rect.Min.Y; y < rect.Max.Y && !found; y++ {
+			found = nonBlack(minX, y)
+		}
+	}
+	if !found {
+		return rect
+	}
+	minY, found := rect.Min.Y, false
+	for ; minY < rect.Max.Y && !found; minY++ {
+		for x := rect.Min.X; x < rect.Max.X && !found; x++ {
+			found = nonBlack(x, minY)
+		}
+	}
+	maxX, found := rect.Max.X-1, false
+	for ; maxX >= rect.Min.X && !found; maxX-- {
+		for y := rect.Max.Y - 1; y >= rect.Min.Y && !found; y-- {
+			found = nonBlack(maxX, y)
+		}
+	}
+	maxY, found := rect.Max.Y-1, false
+	for ; maxY >= rect.Min.Y && !found; maxY-- {
+		for x := rect.Max.X - 1; x >= rect.Min.X && !found; x-- {
+			found = nonBlack(x, maxY)
+		}
+	}
+	// the loops step once past the pixel they found
+	return image.Rect(minX-1, minY-1, maxX+2, maxY+2)
+}
+
+var black = color.NRGBA{A: 255}
+
+// newMap returns a black image with the area visible filled in red.
+func newMap(bounds, visible image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.SetNRGBA(x, y, black)
+		}
+	}
+	for y := visible.Min.Y; y < visible.Max.Y; y++ {
+		for x := visible.Min.X; x < visible.Max.X; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 200, A: 255})
+		}
+	}
+	return img
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	rgba := image.NewRGBA(img.Bounds())
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			rgba.Set(x, y, img.At(x, y))
+		}
+	}
+	return rgba
+}
+
+func TestGetVisible(t *testing.T) {
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(io.Discard)
+
+	bounds := image.Rect(0, 0, 100, 80)
+	visible := image.Rect(20, 10, 60, 50)
+	defaults := VisibleOptions{Background: black}
+
+	tests := []struct {
+		name string
+		img  func() image.Image
+		opts VisibleOptions
+		want image.Rectangle
+	}{
+		{
+			name: "crops to visible area",
+			img:  func() image.Image { return newMap(bounds, visible) },
+			opts: defaults,
+			want: visible,
+		},
+		{
+			name: "crops premultiplied images",
+			img:  func() image.Image { return toRGBA(newMap(bounds, visible)) },
+			opts: defaults,
+			want: visible,
+		},
+		{
+			name: "keeps bounds that do not start at zero",
+			img: func() image.Image {
+				return newMap(image.Rect(-50, -40, 50, 40), image.Rect(-10, -5, 10, 5))
+			},
+			opts: defaults,
+			want: image.Rect(-10, -5, 10, 5),
+		},
+		{
+			name: "pixels within tolerance are empty",
+			img: func() image.Image {
+				img := newMap(bounds, visible)
+				img.SetNRGBA(5, 5, color.NRGBA{R: 10, G: 10, B: 10, A: 255})
+				return img
+			},
+			opts: VisibleOptions{Background: black, Tolerance: 16},
+			want: visible,
+		},
+		{
+			name: "pixels beyond tolerance are visible",
+			img: func() image.Image {
+				img := newMap(bounds, visible)
+				img.SetNRGBA(5, 5, color.NRGBA{R: 20, A: 255})
+				return img
+			},
+			opts: VisibleOptions{Background: black, Tolerance: 16},
+			want: image.Rect(5, 5, 60, 50),
+		},
+		{
+			name: "custom background",
+			img: func() image.Image {
+				img := newMap(bounds, image.Rectangle{})
+				for y := 0; y < bounds.Max.Y; y++ {
+					for x := 0; x < bounds.Max.X; x++ {
+						img.SetNRGBA(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+					}
+				}
+				img.SetNRGBA(30, 40, black)
+				return img
+			},
+			opts: VisibleOptions{Background: color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+			want: image.Rect(30, 40, 31, 41),
+		},
+		{
+			name: "transparent pixels are empty whatever their color",
+			img: func() image.Image {
+				img := newMap(bounds, visible)
+				img.SetNRGBA(5, 5, color.NRGBA{G: 255, A: 8})
+				return img
+			},
+			opts: VisibleOptions{Background: black, AlphaThreshold: 8},
+			want: visible,
+		},
+		{
+			name: "alpha threshold does not follow tolerance",
+			img: func() image.Image {
+				img := newMap(bounds, visible)
+				img.SetNRGBA(5, 5, color.NRGBA{G: 255, A: 8})
+				return img
+			},
+			opts: VisibleOptions{Background: black, Tolerance: 16},
+			want: image.Rect(5, 5, 60, 50),
+		},
+		{
+			name: "translucent premultiplied pixels are compared unpremultiplied",
+			img: func() image.Image {
+				img := toRGBA(newMap(bounds, visible))
+				// white at half alpha, premultiplied
+				img.SetRGBA(5, 5, color.RGBA{R: 128, G: 128, B: 128, A: 128})
+				// black at half alpha, which stays empty
+				img.SetRGBA(90, 70, color.RGBA{A: 128})
+				return img
+			},
+			opts: defaults,
+			want: image.Rect(5, 5, 60, 50),
+		},
+		{
+			name: "padding grows the crop",
+			img:  func() image.Image { return newMap(bounds, visible) },
+			opts: VisibleOptions{Background: black, Padding: 5},
+			want: visible.Inset(-5),
+		},
+		{
+			name: "padding is clamped to the bounds",
+			img:  func() image.Image { return newMap(bounds, visible) },
+			opts: VisibleOptions{Background: black, Padding: 30},
+			want: image.Rect(0, 0, 90, 80),
+		},
+		{
+			name: "all background returns the whole image",
+			img:  func() image.Image { return newMap(bounds, image.Rectangle{}) },
+			opts: defaults,
+			want: bounds,
+		},
+		{
+			name: "fully visible returns the whole image",
+			img:  func() image.Image { return newMap(bounds, bounds) },
+			opts: defaults,
+			want: bounds,
+		},
+		{
+			name: "other image types are converted",
+			img: func() image.Image {
+				img := image.NewGray(bounds)
+				img.SetGray(50, 60, color.Gray{Y: 255})
+				return img
+			},
+			opts: defaults,
+			want: image.Rect(50, 60, 51, 61),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := getVisible(test.img(), test.opts).Bounds()
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// benchmarkMap is about the size of a full resolution capture, with the
+// visible area in the middle so that every scan has to cross the margins.
+func benchmarkMap() *image.NRGBA {
+	return newMap(image.Rect(0, 0, 4000, 3000), image.Rect(800, 600, 3200, 2400))
+}
+
+func BenchmarkGetVisible(b *testing.B) {
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(io.Discard)
+
+	nrgba := benchmarkMap()
+	rgba := toRGBA(nrgba)
+	opts := VisibleOptions{Background: black, Tolerance: 16}
+
+	b.Run("NRGBA", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			getVisible(nrgba, opts)
+		}
+	})
+	b.Run("RGBA", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			getVisible(rgba, opts)
+		}
+	})
+	b.Run("NRGBA_At", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			getVisibleAt(nrgba)
+		}
+	})
+	b.Run("RGBA_At", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			getVisibleAt(rgba)
+		}
+	})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JobKind describes what a job does with the browser page.
+type JobKind string
+
+const (
+	JobLaunch       JobKind = "launch"
+	JobRelaunch     JobKind = "relaunch"
+	JobClose        JobKind = "close"
+	JobCaptureMap   JobKind = "capture map"
+	JobRefreshMap   JobKind = "refresh map"
+	JobListJournal  JobKind = "list journal"
+	JobCaptureSheet JobKind = "capture sheet"
+)
+
+// JobPriority orders queued jobs. Lower values run first.
+type JobPriority int
+
+const (
+	// PriorityUser is for jobs a user is waiting on, and for launching and
+	// closing the browser.
+	PriorityUser JobPriority = iota
+	// PriorityPeriodic is for the regular map capture.
+	PriorityPeriodic
+	// PrioritySweep is for the items of long sweeps, like fetching every
+	// character sheet, which queue one job per item so that other jobs can
+	// run in between.
+	PrioritySweep
+)
+
+// Deadlines of jobs. Playwright calls cannot be interrupted, so the page is
+// closed when a job runs past its own deadline, failing the stuck call.
+// Launches have no page to close until they open one, so a launch stuck
+// before that only notices its deadline at its next check of ctx.
+const (
+	launchTimeout     = 5 * time.Minute
+	captureMapTimeout = 3 * time.Minute
+	sheetTimeout      = 2 * time.Minute
+)
+
+type job struct {
+	ctx      context.Context
+	kind     JobKind
+	priority JobPriority
+	timeout  time.Duration
+	seq      uint64
+	queued   time.Time
+	run      func(ctx context.Context) error
+	done     chan error
+}
+
+// jobHeap orders jobs by priority, then by the order they were queued in.
+type jobHeap []*job
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(*job)) }
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	j := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return j
+}
+
+// QueueStatus is a snapshot of the job queue of a Roll20Browser.
+type QueueStatus struct {
+	// Depth is the number of jobs waiting to run.
+	Depth int
+	// Running is the kind of the job running now, if any.
+	Running JobKind
+	// OldestWait is how long the longest waiting job has been queued.
+	OldestWait time.Duration
+	// LastWait is how long the most recently started job waited.
+	LastWait time.Duration
+}
+
+// jobQueue holds the jobs of a Roll20Browser until its worker runs them.
+type jobQueue struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	jobs     jobHeap
+	seq      uint64
+	running  *job
+	lastWait time.Duration
+	stopped  bool
+}
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *jobQueue) push(j *job) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.stopped {
+		return ErrBrowserClosed
+	}
+	q.seq++
+	j.seq = q.seq
+	heap.Push(&q.jobs, j)
+	q.cond.Signal()
+	return nil
+}
+
+// next waits for the next job to run and marks it as running. It returns
+// nil once the queue is stopped.
+func (q *jobQueue) next() *job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.running = nil
+	for len(q.jobs) == 0 && !q.stopped {
+		q.cond.Wait()
+	}
+	if q.stopped {
+		return nil
+	}
+	j := heap.Pop(&q.jobs).(*job)
+	q.running = j
+	q.lastWait = time.Since(j.queued)
+	return j
+}
+
+// stop fails all queued jobs and rejects new ones.
+func (q *jobQueue) stop() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.stopped = true
+	for _, j := range q.jobs {
+		j.done <- ErrBrowserClosed
+	}
+	q.jobs = nil
+	q.cond.Broadcast()
+}
+
+func (q *jobQueue) status() QueueStatus {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	status := QueueStatus{
+		Depth:    len(q.jobs),
+		LastWait: q.lastWait,
+	}
+	if q.running != nil {
+		status.Running = q.running.kind
+	}
+	for _, j := range q.jobs {
+		if wait := time.Since(j.queued); wait > status.OldestWait {
+			status.OldestWait = wait
+		}
+	}
+	return status
+}
+
+// QueueStatus returns the state of the browser's job queue.
+func (r *Roll20Browser) QueueStatus() QueueStatus {
+	return r.queue.status()
+}
+
+// do queues fn to run on the worker that owns the page and waits for it to
+// finish or for ctx to be done. Once started, fn is given at most timeout
+// to finish, or no deadline if it is zero. Jobs must not queue other jobs,
+// since the worker runs one at a time.
+func (r *Roll20Browser) do(ctx context.Context, kind JobKind, priority JobPriority, timeout time.Duration, fn func(ctx context.Context) error) error {
+	j := &job{
+		ctx:      ctx,
+		kind:     kind,
+		priority: priority,
+		timeout:  timeout,
+		queued:   time.Now(),
+		run:      fn,
+		done:     make(chan error, 1),
+	}
+	if err := r.queue.push(j); err != nil {
+		return err
+	}
+	select {
+	case err := <-j.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work runs queued jobs one at a time until the queue is stopped.
+func (r *Roll20Browser) work() {
+	for {
+		j := r.queue.next()
+		if j == nil {
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"instance": r.game,
+			"job":      j.kind,
+			"wait":     time.Since(j.queued).Round(time.Millisecond),
+			"queued":   r.queue.status().Depth,
+		}).Printf("Running %s job", j.kind)
+		j.done <- r.runJob(j)
+	}
+}
+
+func (r *Roll20Browser) runJob(j *job) error {
+	if err := j.ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx := j.ctx
+	if j.timeout > 0 {
+		// only the job's own deadline closes the page: a caller giving up
+		// must not break the page for the jobs after it
+		deadline, cancelDeadline := context.WithTimeout(context.Background(), j.timeout)
+		defer cancelDeadline()
+
+		stop := context.AfterFunc(deadline, func() {
+			// read the page when the deadline passes, since launches
+			// replace it while they run
+			r.pageLock.Lock()
+			page := r.page
+			r.pageLock.Unlock()
+			if page != nil {
+				logrus.Errorf("%s job did not finish in time, closing page", j.kind)
+				page.Close()
+			}
+		})
+		defer stop()
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.timeout)
+		defer cancel()
+	}
+
+	return j.run(ctx)
+}
+
+// sleepContext sleeps for d, returning early with an error if ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}